@@ -60,19 +60,23 @@ func init() {
 	log.SetOutput(logWriter)
 }
 
-// SetupTempLog adds a new log sink which writes all logs to the given file.
-func RegisterSink(f *os.File) {
-	l, ok := logger.(hclog.InterceptLogger)
+// RegisterSink adds a new log sink to l, or to the global logger if l is nil,
+// which writes its logs of at least the given level to the given file.
+func RegisterSink(l hclog.Logger, f *os.File, level hclog.Level) {
+	if l == nil {
+		l = logger
+	}
+	il, ok := l.(hclog.InterceptLogger)
 	if !ok {
-		panic("global logger is not an InterceptLogger")
+		panic("logger is not an InterceptLogger")
 	}
 
 	if f == nil {
 		return
 	}
 
-	l.RegisterSink(hclog.NewSinkAdapter(&hclog.LoggerOptions{
-		Level:  hclog.Trace,
+	il.RegisterSink(hclog.NewSinkAdapter(&hclog.LoggerOptions{
+		Level:  level,
 		Output: f,
 	}))
 }
@@ -121,18 +125,40 @@ func NewLogger(name string) hclog.Logger {
 	}
 }
 
-// NewProviderLogger returns a logger for the provider plugin, possibly with a
-// different log level from the global logger.
-func NewProviderLogger(prefix string) hclog.Logger {
-	l := &logPanicWrapper{
-		Logger: logger.Named(prefix + "provider"),
+// NewProviderLogger returns a logger for a provider process, which forwards
+// its logs to out (usually the Steampipe plugin logger) under the given name,
+// keeping their level, and to logFile if it isn't nil. Logs less severe than
+// level are dropped. prefix identifies the process, see ProviderPanic.
+func NewProviderLogger(prefix, name string, out hclog.Logger, level hclog.Level, logFile *os.File) hclog.Logger {
+	// the logger of each process has its own sinks, since sinks are shared by
+	// all loggers derived from the same one
+	l := hclog.NewInterceptLogger(&hclog.LoggerOptions{
+		Name:   name,
+		Level:  hclog.Off,
+		Output: io.Discard,
+	})
+	l.RegisterSink(&forwardSink{out: out, level: level})
+	RegisterSink(l, logFile, level)
+	out.Debug("created provider logger", "name", name, "level", level)
+
+	return &logPanicWrapper{
+		Logger:   l,
+		recordAs: prefix + "provider",
 	}
+}
 
-	level := providerLogLevel()
-	logger.Debug("created provider logger", "level", level)
+// forwardSink is an hclog.SinkAdapter that sends logs of at least level to
+// another logger.
+type forwardSink struct {
+	out   hclog.Logger
+	level hclog.Level
+}
 
-	l.SetLevel(level)
-	return l
+func (s *forwardSink) Accept(name string, level hclog.Level, msg string, args ...interface{}) {
+	if level < s.level || s.level == hclog.Off {
+		return
+	}
+	s.out.ResetNamed(name).Log(level, msg, args...)
 }
 
 // NewCloudLogger returns a logger for the cloud plugin, possibly with a
@@ -155,6 +181,15 @@ func CurrentLogLevel() string {
 	return strings.ToUpper(ll.String())
 }
 
+// ProviderLogLevel returns the log level for providers on the environment, or
+// hclog.NoLevel if it isn't set.
+func ProviderLogLevel() hclog.Level {
+	if os.Getenv(envLogProvider) == "" && os.Getenv(envLog) == "" {
+		return hclog.NoLevel
+	}
+	return providerLogLevel()
+}
+
 func providerLogLevel() hclog.Level {
 	providerEnvLevel := strings.ToUpper(os.Getenv(envLogProvider))
 	if providerEnvLevel == "" {
@@ -221,13 +256,13 @@ func isValidLogLevel(level string) bool {
 }
 
 // PluginOutputMonitor creates an io.Writer that will warn about any writes in
-// the default logger. This is used to catch unexpected output from plugins,
+// the given logger. This is used to catch unexpected output from plugins,
 // notifying them about the problem as well as surfacing the lost data for
 // context.
-func PluginOutputMonitor(source string) io.Writer {
+func PluginOutputMonitor(source string, log hclog.Logger) io.Writer {
 	return pluginOutputMonitor{
 		source: source,
-		log:    logger,
+		log:    log,
 	}
 }
 
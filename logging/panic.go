@@ -124,6 +124,21 @@ func (p *panicRecorder) registerPlugin(name string) func(string) {
 	}
 }
 
+// ProviderPanic returns the panic output recorded for the provider whose
+// logger was created by NewProviderLogger(prefix), or "" if it didn't panic.
+// Unlike PluginPanics, the output isn't formatted, so that the caller can
+// describe the provider.
+func ProviderPanic(prefix string) string {
+	return panics.pluginPanic(prefix + "provider")
+}
+
+func (p *panicRecorder) pluginPanic(name string) string {
+	p.Lock()
+	defer p.Unlock()
+
+	return strings.Join(p.panics[name], "\n")
+}
+
 func (p *panicRecorder) allPanics() []string {
 	p.Lock()
 	defer p.Unlock()
@@ -145,13 +160,22 @@ type logPanicWrapper struct {
 	hclog.Logger
 	panicRecorder func(string)
 	inPanic       bool
+
+	// recordAs is the name that panics are recorded under, instead of the
+	// name of the plugin binary, so that several processes of the same
+	// binary can be told apart (see ProviderPanic).
+	recordAs string
 }
 
 // go-plugin will create a new named logger for each plugin binary.
 func (l *logPanicWrapper) Named(name string) hclog.Logger {
+	recordAs := name
+	if l.recordAs != "" {
+		recordAs = l.recordAs
+	}
 	return &logPanicWrapper{
 		Logger:        l.Logger.Named(name),
-		panicRecorder: panics.registerPlugin(name),
+		panicRecorder: panics.registerPlugin(recordAs),
 	}
 }
 
@@ -44,34 +44,52 @@ func grpcErr(err error) (diags tfdiags.Diagnostics) {
 	// plugin. The grpc plugin does not know its configured name, and the
 	// errors are in a list of diagnostics, making it hard for the caller to
 	// annotate the returned errors.
-	switch status.Code(err) {
+	var diag tfdiags.Diagnostic
+	code := status.Code(err)
+	switch code {
 	case codes.Unavailable:
 		// This case is when the plugin has stopped running for some reason,
 		// and is usually the result of a crash.
-		diags = diags.Append(tfdiags.Sourceless(
+		diag = tfdiags.Sourceless(
 			tfdiags.Error,
 			"Plugin did not respond",
 			fmt.Sprintf("The plugin encountered an error, and failed to respond to the %s call. "+
 				"The plugin logs may contain more details.", requestName),
-		))
+		)
 	case codes.Canceled:
-		diags = diags.Append(tfdiags.Sourceless(
+		diag = tfdiags.Sourceless(
 			tfdiags.Error,
 			"Request cancelled",
 			fmt.Sprintf("The %s request was cancelled.", requestName),
-		))
+		)
+	case codes.DeadlineExceeded:
+		diag = tfdiags.WholeContainingBody(
+			tfdiags.Error,
+			"Request timed out",
+			fmt.Sprintf("The %s request did not complete before its deadline.", requestName),
+		)
 	case codes.Unimplemented:
-		diags = diags.Append(tfdiags.Sourceless(
+		diag = tfdiags.Sourceless(
 			tfdiags.Error,
 			"Unsupported plugin method",
 			fmt.Sprintf("The %s method is not supported by this plugin.", requestName),
-		))
+		)
 	default:
-		diags = diags.Append(tfdiags.Sourceless(
+		diag = tfdiags.Sourceless(
 			tfdiags.Error,
 			"Plugin error",
 			fmt.Sprintf("The plugin returned an unexpected error from %s: %v", requestName, err),
-		))
+		)
 	}
-	return
+
+	// keep the status code around, callers may want to react to specific codes
+	return diags.Append(tfdiags.WithExtra(diag, grpcStatusExtra(code)))
+}
+
+// grpcStatusExtra is attached to the diagnostics created by grpcErr, see
+// tfdiags.DiagnosticExtraGRPCStatus
+type grpcStatusExtra codes.Code
+
+func (e grpcStatusExtra) GRPCStatusCode() codes.Code {
+	return codes.Code(e)
 }
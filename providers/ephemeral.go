@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package providers
+
+import (
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+)
+
+// NOTE: ClientCapabilities and Deferred are left out of these types, the
+// bridge never allows the provider to defer opening an ephemeral resource.
+
+// OpenEphemeralResourceRequest represents the arguments for the OpenEphemeralResource
+// operation on a provider.
+type OpenEphemeralResourceRequest struct {
+	// TypeName is the type of ephemeral resource to open. This should
+	// only be one of the type names previously reported in the provider's
+	// schema.
+	TypeName string
+
+	// Config is an object-typed value representing the configuration for
+	// the ephemeral resource instance that the caller is trying to open.
+	//
+	// The object type of this value always conforms to the resource type
+	// schema's implied type, and uses null values to represent attributes
+	// that were not explicitly assigned in the configuration block.
+	// Computed-only attributes are always null in the configuration, because
+	// they can be set only in the response.
+	Config cty.Value
+}
+
+// OpenEphemeralResourceRequest represents the response from an OpenEphemeralResource
+// operation on a provider.
+type OpenEphemeralResourceResponse struct {
+	// Result is an object-typed value representing the newly-opened session
+	// with the opened ephemeral object.
+	//
+	// The object type of this value always conforms to the resource type
+	// schema's implied type.
+	Result cty.Value
+
+	// Private is any internal data needed by the provider to perform a
+	// subsequent [Interface.CloseEphemeralResource] request for the same object. The
+	// provider may choose any encoding format to represent the needed data,
+	// because Terraform Core treats this field as opaque.
+	//
+	// It's guaranteed that a CloseEphemeralResource request will be
+	// received by exactly the same plugin instance that returned this value,
+	// and so it's valid for this to refer to in-memory state belonging to the
+	// provider instance.
+	Private []byte
+
+	// RenewAt, if non-zero, signals that the opened object has an inherent
+	// expiration time and so must be "renewed" if Terraform needs to use it
+	// beyond that expiration time.
+	//
+	// If a provider sets this field then it may receive a subsequent
+	// Interface.RenewEphemeralResource call, if Terraform expects to need the
+	// object beyond the expiration time.
+	RenewAt time.Time
+
+	// Diagnostics describes any problems encountered while opening the
+	// ephemeral resource. If this contains errors then the other response
+	// fields must be assumed invalid.
+	Diagnostics tfdiags.Diagnostics
+}
+
+// RenewEphemeralResourceRequest represents the arguments for the RenewEphemeralResource
+// operation on a provider.
+type RenewEphemeralResourceRequest struct {
+	// TypeName is the type of ephemeral resource being renewed. This should
+	// only be one of the type names previously sent in a successful
+	// [OpenEphemeralResourceRequest].
+	TypeName string
+
+	// Private echoes verbatim the value from the field of the same
+	// name from the most recent [OpenEphemeralResourceResponse] or
+	// [RenewEphemeralResourceResponse] object.
+	Private []byte
+}
+
+// RenewEphemeralResourceRequest represents the response from a RenewEphemeralResource
+// operation on a provider.
+type RenewEphemeralResourceResponse struct {
+	// RenewAt, if non-zero, describes a new expiration deadline for the
+	// object, possibly causing a further call to [Interface.RenewEphemeralResource]
+	// if Terraform needs to exceed the updated deadline.
+	//
+	// If this is not set then Terraform Core will not make any further
+	// renewal requests for the remaining life of the object.
+	RenewAt time.Time
+
+	// Private is any internal data needed by the provider to
+	// perform a subsequent [Interface.RenewEphemeralResource] request. The provider
+	// may choose any encoding format to represent the needed data, because
+	// Terraform Core treats this field as opaque.
+	Private []byte
+
+	// Diagnostics describes any problems encountered while renewing the
+	// ephemeral resource instance. If this contains errors then the other
+	// response fields must be assumed invalid.
+	Diagnostics tfdiags.Diagnostics
+}
+
+// CloseEphemeralResourceRequest represents the arguments for the CloseEphemeralResource
+// operation on a provider.
+type CloseEphemeralResourceRequest struct {
+	// TypeName is the type of ephemeral resource being closed. This should
+	// only be one of the type names previously sent in a successful
+	// [OpenEphemeralResourceRequest].
+	TypeName string
+
+	// Private echoes verbatim the value from the field of the same
+	// name from the corresponding [OpenEphemeralResourceResponse] object.
+	Private []byte
+}
+
+// CloseEphemeralResourceRequest represents the response from a CloseEphemeralResource
+// operation on a provider.
+type CloseEphemeralResourceResponse struct {
+	// Diagnostics describes any problems encountered while closing the
+	// ephemeral resource instance. If this contains errors then the other
+	// response fields must be assumed invalid.
+	//
+	// If closing an ephemeral resource instance fails then it's unspecified
+	// whether a corresponding remote object remains valid or not.
+	Diagnostics tfdiags.Diagnostics
+}
@@ -0,0 +1,37 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package providers
+
+import (
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+)
+
+// NOTE: upstream also has FunctionDecl.BuildFunction, which wraps a function
+// into a cty function for HCL evaluation, and FunctionResults, which checks
+// that functions are pure across a plan and apply. Neither is needed to call
+// functions directly, so they are left out.
+
+type FunctionDecl struct {
+	Parameters        []FunctionParam
+	VariadicParameter *FunctionParam
+	ReturnType        cty.Type
+
+	Description        string
+	DescriptionKind    configschema.StringKind
+	Summary            string
+	DeprecationMessage string
+}
+
+type FunctionParam struct {
+	Name string // Only for documentation and UI, because arguments are positional
+	Type cty.Type
+
+	AllowNullValue     bool
+	AllowUnknownValues bool
+
+	Description     string
+	DescriptionKind configschema.StringKind
+}
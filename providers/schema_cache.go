@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package providers
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SchemaCache is a global cache of provider schemas, shared by all the
+// processes of the same provider and version (the bridge may run several, one
+// per provider configuration), so that multi-megabyte schemas such as AWS's
+// are only transferred and decoded once.
+//
+// Like in Terraform, a cached schema is only used instead of calling
+// GetProviderSchema if the provider reported the GetProviderSchemaOptional
+// capability. Older providers must receive that call in every process.
+var SchemaCache = &schemaCache{
+	m: make(map[string]GetProviderSchemaResponse),
+}
+
+// Global cache for provider schemas, keyed by provider address and version
+// Cache the entire response to ensure we capture any new fields, like
+// ServerCapabilities.
+type schemaCache struct {
+	mu sync.Mutex
+	m  map[string]GetProviderSchemaResponse
+}
+
+func (c *schemaCache) Set(key string, s GetProviderSchemaResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.m[key] = s
+}
+
+func (c *schemaCache) Get(key string) (GetProviderSchemaResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.m[key]
+	return s, ok
+}
+
+// SchemaFile returns where the schema of the provider identified by key is
+// persisted inside dir. The schema is stored as the raw GetProviderSchema
+// response, whose format depends on the protocol version, so that's part of
+// the name too.
+func SchemaFile(dir, key, protocol string) string {
+	return filepath.Join(dir, filepath.FromSlash(key), "schema."+protocol+".pb")
+}
+
+// ReadSchemaFile returns the raw schema persisted by WriteSchemaFile, or nil
+// if there is none.
+func ReadSchemaFile(dir, key, protocol string) ([]byte, error) {
+	raw, err := os.ReadFile(SchemaFile(dir, key, protocol))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return raw, err
+}
+
+// WriteSchemaFile persists a raw schema, so that later runs of the plugin can
+// skip GetProviderSchema. A provider version never changes its schema, so the
+// file is never invalidated.
+func WriteSchemaFile(dir, key, protocol string, raw []byte) error {
+	path := SchemaFile(dir, key, protocol)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// other processes may be reading the file, so it's replaced in one step
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".schema-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -2,23 +2,133 @@ package tfbridge
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
+	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
-	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/schema"
+	"github.com/zclconf/go-cty/cty"
 )
 
+// TFBridgeConfig is parsed from the connection's block in the .spc file
+// Since it contains nested blocks, it uses HCL tags instead of the older ConfigSchema+cty tags approach
 type TFBridgeConfig struct {
-	Provider       *string `cty:"provider"`
-	Version        *string `cty:"version"`
-	ProviderConfig *string `cty:"provider_config"`
+	// These configure a single provider, and are kept for compatibility with the first versions of the plugin
+	// Multiple providers are configured with provider "name" {...} blocks, see ProviderBlock
+	Provider       *string `hcl:"provider,optional"`
+	Version        *string `hcl:"version,optional"`
+	ProviderConfig *string `hcl:"provider_config,optional"`
+
+	Providers []ProviderBlock `hcl:"provider,block"`
+	AliasMode *string         `hcl:"alias_mode,optional"`
+
+	// TerraformDir is a Terraform module whose providers are added to the ones above, see loadTerraformDir
+	TerraformDir *string `hcl:"terraform_dir,optional"`
+
+	Tables                    []string `hcl:"tables,optional"`
+	ExcludeTables             []string `hcl:"exclude_tables,optional"`
+	TablePrefix               *string  `hcl:"table_prefix,optional"`
+	SkipDeprecatedDataSources *bool    `hcl:"skip_deprecated_data_sources,optional"`
+
+	Resources           []string `hcl:"resources,optional"`
+	ResourceTablePrefix *string  `hcl:"resource_table_prefix,optional"`
+
+	FunctionTablePrefix *string `hcl:"function_table_prefix,optional"`
+
+	EphemeralTablePrefix *string `hcl:"ephemeral_table_prefix,optional"`
+
+	SchemaCacheDir *string `hcl:"schema_cache_dir,optional"`
+
+	ProviderIdleTimeout  *string `hcl:"provider_idle_timeout,optional"`
+	MaxProviderProcesses *int    `hcl:"max_provider_processes,optional"`
+
+	ReattachProviders *string `hcl:"reattach_providers,optional"`
+
+	ProviderEnv           map[string]string `hcl:"provider_env,optional"`
+	ProviderEnvAllowlist  []string          `hcl:"provider_env_allowlist,optional"`
+	ProviderWorkingDir    *string           `hcl:"provider_working_dir,optional"`
+	ProviderMaxMemoryMB   *int              `hcl:"provider_max_memory_mb,optional"`
+	ProviderMaxCPUSeconds *int              `hcl:"provider_max_cpu_seconds,optional"`
+	ProviderMaxOpenFiles  *int              `hcl:"provider_max_open_files,optional"`
+	ProviderAutoMTLS      *bool             `hcl:"provider_auto_mtls,optional"`
+
+	ProviderLogLevel *string `hcl:"provider_log_level,optional"`
+	LogPath          *string `hcl:"log_path,optional"`
+
+	StateFiles       []string `hcl:"state_files,optional"`
+	StateRefresh     *bool    `hcl:"state_refresh,optional"`
+	StateTablePrefix *string  `hcl:"state_table_prefix,optional"`
+
+	FlattenNestedBlocks *bool `hcl:"flatten_nested_blocks,optional"`
+	FlattenMaxDepth     *int  `hcl:"flatten_max_depth,optional"`
+
+	ReadTimeout *string `hcl:"read_timeout,optional"`
+
+	RetryMaxAttempts *int     `hcl:"retry_max_attempts,optional"`
+	RetryBackoff     *string  `hcl:"retry_backoff,optional"`
+	RetryInterval    *string  `hcl:"retry_interval,optional"`
+	RetryMaxInterval *string  `hcl:"retry_max_interval,optional"`
+	RetryOnSummary   []string `hcl:"retry_on_summary,optional"`
+	RetryOnDetail    []string `hcl:"retry_on_detail,optional"`
+	RetryOnGRPCCodes []string `hcl:"retry_on_grpc_codes,optional"`
+
+	MaxConcurrency           *int     `hcl:"max_concurrency,optional"`
+	RateLimit                *float64 `hcl:"rate_limit,optional"`
+	RateLimitBurst           *int     `hcl:"rate_limit_burst,optional"`
+	DataSourceRateLimit      *float64 `hcl:"data_source_rate_limit,optional"`
+	DataSourceRateLimitBurst *int     `hcl:"data_source_rate_limit_burst,optional"`
+}
+
+// ProviderBlock holds the configuration of one of the Terraform providers exposed by a connection
+// The label is a name for the provider, much like the local names in Terraform's required_providers block
+// Like in Terraform, a provider may be configured several times (e.g. for different GitHub orgs or AWS regions)
+// by adding several blocks with the same label and a different alias on each. Those blocks share the same
+// provider binary, so only one of them needs to set source and version
+type ProviderBlock struct {
+	Name           string  `hcl:"name,label"`
+	Alias          *string `hcl:"alias,optional"`
+	Source         string  `hcl:"source,optional"`
+	Version        string  `hcl:"version,optional"`
+	ProviderConfig *string `hcl:"provider_config,optional"`
+	TablePrefix    *string `hcl:"table_prefix,optional"`
+
+	// variables are the values of the var.* references on the provider config, only for providers read from
+	// terraform_dir
+	variables providerVariables
+}
+
+// providerVariables are the values of the input variables of a Terraform directory, which usually include secrets
+// (e.g. from terraform.tfvars or TF_VAR_*), so they print without their values
+type providerVariables map[string]cty.Value
+
+func (v providerVariables) String() string {
+	return fmt.Sprintf("(%d variables, values hidden)", len(v))
 }
 
-var ConfigSchema = map[string]*schema.Attribute{
-	"provider":        {Type: schema.TypeString},
-	"version":         {Type: schema.TypeString},
-	"provider_config": {Type: schema.TypeString},
+func (v providerVariables) GoString() string {
+	return v.String()
 }
 
+const (
+	// aliasModeColumn exposes a single set of tables for all the configurations of a provider, with an
+	// extra _alias column that tells where each row came from
+	aliasModeColumn = "column"
+	// aliasModePrefix exposes a set of tables for each configuration of a provider, prefixed with the alias
+	aliasModePrefix = "prefix"
+)
+
+// defaultFlattenMaxDepth is enough for most providers, whose blocks rarely nest deeper than that
+const defaultFlattenMaxDepth = 3
+
+const defaultResourceTablePrefix = "resource_"
+
+const defaultStateTablePrefix = "state_"
+
+const defaultFunctionTablePrefix = "function_"
+
+const defaultEphemeralTablePrefix = "ephemeral_"
+
 func ConfigInstance() interface{} {
 	return &TFBridgeConfig{}
 }
@@ -32,8 +142,237 @@ func GetConfig(connection *plugin.Connection) TFBridgeConfig {
 	return config
 }
 
+// String only shows what's on the .spc file: unlike GetProviders, it doesn't read terraform_dir again every time the
+// config is logged
 func (c TFBridgeConfig) String() string {
-	return fmt.Sprintf(
-		"TFBridgeConfig{provider=%s v%s, other_config=%v}",
-		*c.Provider, *c.Version, *c.ProviderConfig)
+	var providers []string
+	if c.Provider != nil {
+		providers = append(providers, *c.Provider)
+	}
+	for _, p := range c.Providers {
+		providers = append(providers, p.String())
+	}
+	if c.TerraformDir != nil {
+		return fmt.Sprintf("TFBridgeConfig{providers=%v, terraform_dir=%s}", providers, *c.TerraformDir)
+	}
+	return fmt.Sprintf("TFBridgeConfig{providers=%v}", providers)
+}
+
+func (p ProviderBlock) String() string {
+	if p.Alias != nil {
+		return fmt.Sprintf("%s.%s=%s v%s", p.Name, *p.Alias, p.Source, p.Version)
+	}
+	return fmt.Sprintf("%s=%s v%s", p.Name, p.Source, p.Version)
+}
+
+// GetProviders returns every provider configured on the connection, both from the provider "name" {...} blocks
+// and from the older provider/version/provider_config attributes
+func (c TFBridgeConfig) GetProviders() ([]ProviderBlock, error) {
+	providers := make([]ProviderBlock, 0, len(c.Providers)+1)
+
+	if c.Provider != nil || c.Version != nil || c.ProviderConfig != nil {
+		if c.Provider == nil || c.Version == nil {
+			return nil, fmt.Errorf("both provider and version must be set when configuring a provider without a provider block")
+		}
+		// use the same name that Terraform would implicitly give the provider
+		addr, err := tfaddr.ParseProviderSource(*c.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider %q: %w", *c.Provider, err)
+		}
+		providers = append(providers, ProviderBlock{
+			Name:           addr.Type,
+			Source:         *c.Provider,
+			Version:        *c.Version,
+			ProviderConfig: c.ProviderConfig,
+		})
+	}
+	providers = append(providers, c.Providers...)
+
+	// providers on the .spc file take precedence, so that some of them can be configured differently than in Terraform
+	if c.TerraformDir != nil {
+		fromDir, err := loadTerraformDir(*c.TerraformDir)
+		if err != nil {
+			return nil, fmt.Errorf("reading terraform_dir %s: %w", *c.TerraformDir, err)
+		}
+		overridden := map[string]bool{}
+		for _, p := range providers {
+			overridden[p.Name] = true
+		}
+		for _, p := range fromDir {
+			if !overridden[p.Name] {
+				providers = append(providers, p)
+			}
+		}
+	}
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no Terraform provider configured: set provider and version, add provider blocks, or set terraform_dir")
+	}
+
+	// every name+alias pair must be unique, and all blocks with the same name must agree on source and version
+	configured := map[string]bool{}
+	binaries := map[string]ProviderBlock{}
+	for _, p := range providers {
+		key := p.Name + "." + p.GetAlias()
+		if configured[key] {
+			return nil, fmt.Errorf("provider %q is configured more than once with the same alias, set a different alias on each block", p.Name)
+		}
+		configured[key] = true
+
+		if p.Source == "" && p.Version == "" {
+			continue
+		}
+		if other, ok := binaries[p.Name]; ok && (other.Source != p.Source || other.Version != p.Version) {
+			return nil, fmt.Errorf("all configurations of provider %q must use the same source and version", p.Name)
+		}
+		binaries[p.Name] = p
+	}
+	// then fill in source and version on the blocks that omitted them
+	for i, p := range providers {
+		binary, ok := binaries[p.Name]
+		if !ok || binary.Source == "" || binary.Version == "" {
+			return nil, fmt.Errorf("provider %q must set both source and version", p.Name)
+		}
+		providers[i].Source, providers[i].Version = binary.Source, binary.Version
+	}
+	return providers, nil
+}
+
+// GetAliasMode returns how providers that are configured several times are exposed, see aliasModeColumn and
+// aliasModePrefix
+func (c TFBridgeConfig) GetAliasMode() (string, error) {
+	if c.AliasMode == nil || *c.AliasMode == "" {
+		return aliasModeColumn, nil
+	}
+	if *c.AliasMode != aliasModeColumn && *c.AliasMode != aliasModePrefix {
+		return "", fmt.Errorf("invalid alias_mode %q: must be %q or %q", *c.AliasMode, aliasModeColumn, aliasModePrefix)
+	}
+	return *c.AliasMode, nil
+}
+
+// GetAlias returns the alias of this configuration of the provider, or the name of the provider if it has no alias
+// This is the value of the _alias column for the rows that come from this configuration
+func (p ProviderBlock) GetAlias() string {
+	if p.Alias == nil {
+		return p.Name
+	}
+	return *p.Alias
+}
+
+// GetTablePrefix returns the prefix that is added to the names of all the tables of the connection, before the
+// table_prefix of each provider (if any)
+func (c TFBridgeConfig) GetTablePrefix() string {
+	if c.TablePrefix == nil {
+		return ""
+	}
+	return *c.TablePrefix
+}
+
+// GetProviderConfig returns the body of the provider "x" {...} block that should be sent to the provider,
+// which may be empty if the provider doesn't need any configuration
+func (p ProviderBlock) GetProviderConfig() string {
+	if p.ProviderConfig == nil {
+		return ""
+	}
+	return *p.ProviderConfig
+}
+
+// GetTablePrefix returns the prefix that is added to the names of the tables created from this provider
+func (p ProviderBlock) GetTablePrefix() string {
+	if p.TablePrefix == nil {
+		return ""
+	}
+	return *p.TablePrefix
+}
+
+// GetResourceTablePrefix returns the prefix that sets the tables of resource types apart from those of data sources,
+// since both often share the same name (e.g. github_repository). It goes after all other prefixes
+func (c TFBridgeConfig) GetResourceTablePrefix() string {
+	if c.ResourceTablePrefix == nil {
+		return defaultResourceTablePrefix
+	}
+	return *c.ResourceTablePrefix
+}
+
+// GetFunctionTablePrefix returns the prefix of the tables created from provider-defined functions, which goes
+// before the name of the provider block (so provider::aws::arn_parse becomes function_aws_arn_parse)
+func (c TFBridgeConfig) GetFunctionTablePrefix() string {
+	if c.FunctionTablePrefix == nil {
+		return defaultFunctionTablePrefix
+	}
+	return *c.FunctionTablePrefix
+}
+
+// GetSchemaCacheDir returns where provider schemas are persisted, so that later runs of the plugin don't have to
+// request them again. By default it's a directory inside the user's cache dir (e.g. ~/.cache on Linux), and an empty
+// string disables persisting them
+func (c TFBridgeConfig) GetSchemaCacheDir() string {
+	if c.SchemaCacheDir != nil {
+		return *c.SchemaCacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		// e.g. no $HOME, schemas are still shared between processes, just not persisted
+		return ""
+	}
+	return filepath.Join(dir, "steampipe-plugin-tfbridge", "schemas")
+}
+
+// GetEphemeralTablePrefix returns the prefix of the tables created from ephemeral resource types, which sets them
+// apart from data sources with the same name. Like GetResourceTablePrefix, it goes after all other prefixes
+func (c TFBridgeConfig) GetEphemeralTablePrefix() string {
+	if c.EphemeralTablePrefix == nil {
+		return defaultEphemeralTablePrefix
+	}
+	return *c.EphemeralTablePrefix
+}
+
+// GetStateTablePrefix returns the prefix of the tables that expose the resources found in state files, which sets
+// them apart from data source and resource tables. Like GetResourceTablePrefix, it goes after all other prefixes
+func (c TFBridgeConfig) GetStateTablePrefix() string {
+	if c.StateTablePrefix == nil {
+		return defaultStateTablePrefix
+	}
+	return *c.StateTablePrefix
+}
+
+// GetStateRefresh returns true if resources read from state files should be refreshed against the remote system
+func (c TFBridgeConfig) GetStateRefresh() bool {
+	return c.StateRefresh != nil && *c.StateRefresh
+}
+
+// GetFlattenDepth returns how many levels of nested blocks are flattened into their own columns (see makeFields),
+// which is 0 unless flatten_nested_blocks is set
+func (c TFBridgeConfig) GetFlattenDepth() (int, error) {
+	if c.FlattenNestedBlocks == nil || !*c.FlattenNestedBlocks {
+		return 0, nil
+	}
+	if c.FlattenMaxDepth == nil {
+		return defaultFlattenMaxDepth, nil
+	}
+	if *c.FlattenMaxDepth < 1 {
+		return 0, fmt.Errorf("invalid flatten_max_depth %d: must be at least 1", *c.FlattenMaxDepth)
+	}
+	return *c.FlattenMaxDepth, nil
+}
+
+// GetReadTimeout parses the read_timeout option (a Go duration string, such as "30s" or "5m")
+// A zero duration means that reads are never timed out, which is also the default
+func (c TFBridgeConfig) GetReadTimeout() (time.Duration, error) {
+	return parseDurationOption("read_timeout", c.ReadTimeout, 0)
+}
+
+// parseDurationOption parses an optional config value that holds a Go duration string, returning def if unset
+func parseDurationOption(name string, value *string, def time.Duration) (time.Duration, error) {
+	if value == nil || *value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(*value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, *value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, *value)
+	}
+	return d, nil
 }
@@ -63,6 +63,9 @@ func isProviderBinary(ctx context.Context, fname string, provider tfaddr.Provide
 DownloadProvider uses the Terraform Registry API to download a provider binary into the temp directory.
 */
 func DownloadProvider(ctx context.Context, name, version string, d *plugin.TableMapData) (path string, err error) {
+	ctx, op := startOperation(ctx, opDownload, sourceAddress(name))
+	defer func() { op.end(err, nil) }()
+
 	provider, err := tfaddr.ParseProviderSource(name)
 	if err != nil {
 		return
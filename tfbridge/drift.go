@@ -0,0 +1,149 @@
+package tfbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+	"github.com/zclconf/go-cty/cty"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+)
+
+// sensitiveValue replaces the values of sensitive attributes, like Terraform does on its plans
+const sensitiveValue = "(sensitive value)"
+
+// attributeChange is an attribute whose value on the state differs from the one on the remote system
+type attributeChange struct {
+	// path is written like Terraform does in its plans and in `terraform state show`, e.g. settings[0].enabled
+	// or tags["env"]
+	path      string
+	old, new  cty.Value
+	sensitive bool
+}
+
+// oldJSON and newJSON return the values of the change, ready for a JSONB column, or sensitiveValue if they must
+// not be shown
+func (c attributeChange) oldJSON() (any, error) {
+	return maskedJSON(c.old, c.sensitive)
+}
+
+func (c attributeChange) newJSON() (any, error) {
+	return maskedJSON(c.new, c.sensitive)
+}
+
+func maskedJSON(val cty.Value, sensitive bool) (any, error) {
+	if sensitive {
+		return sensitiveValue, nil
+	}
+	if val.IsNull() {
+		return nil, nil
+	}
+	raw, err := ctyJson.SimpleJSONValue{Value: val}.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var x any
+	err = json.Unmarshal(raw, &x)
+	return x, err
+}
+
+// diffValues returns the attributes that differ between two values of a resource, which should have the same type
+// The walk goes as deep as it can, so a change to a single tag is reported as tags["env"] and not as the whole
+// map. Lists of different lengths and sets (whose elements have no stable address) are reported as a whole
+// block is the resource's schema, which tells the attributes that are sensitive. Those are reported as a whole too,
+// so that not even the shape of the change is shown, and so is any change reported as a whole that holds one
+func diffValues(old, new cty.Value, block *configschema.Block) []attributeChange {
+	var changes []attributeChange
+	collectChanges(&changes, "", old, new, block, false)
+	return changes
+}
+
+// collectChanges walks old and new at the same time, appending every difference to changes
+// block describes the next object that the walk reaches (it passes unchanged through lists, sets and maps, which
+// hold the objects of a nested block), and is nil inside values that have no schema of their own. sensitive is
+// carried through lists and maps too
+func collectChanges(changes *[]attributeChange, path string, old, new cty.Value, block *configschema.Block, sensitive bool) {
+	if old.RawEquals(new) {
+		return
+	}
+
+	ty := old.Type()
+	switch {
+	case sensitive || old.IsNull() || new.IsNull() || !old.IsKnown() || !new.IsKnown() || !ty.Equals(new.Type()):
+		// nothing to walk into, see below
+	case ty.IsObjectType():
+		names := make([]string, 0, len(ty.AttributeTypes()))
+		for name := range ty.AttributeTypes() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childBlock, childSensitive := childSchema(block, name)
+			collectChanges(changes, joinAttributePath(path, name), old.GetAttr(name), new.GetAttr(name), childBlock, childSensitive)
+		}
+		return
+	case (ty.IsListType() || ty.IsTupleType()) && old.LengthInt() == new.LengthInt():
+		for i := 0; i < old.LengthInt(); i++ {
+			index := cty.NumberIntVal(int64(i))
+			collectChanges(changes, fmt.Sprintf("%s[%d]", path, i), old.Index(index), new.Index(index), block, sensitive)
+		}
+		return
+	case ty.IsMapType():
+		oldMap, newMap := old.AsValueMap(), new.AsValueMap()
+		keys := map[string]bool{}
+		for k := range oldMap {
+			keys[k] = true
+		}
+		for k := range newMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			o, ok := oldMap[k]
+			if !ok {
+				o = cty.NullVal(ty.ElementType())
+			}
+			n, ok := newMap[k]
+			if !ok {
+				n = cty.NullVal(ty.ElementType())
+			}
+			quoted, _ := json.Marshal(k)
+			collectChanges(changes, fmt.Sprintf("%s[%s]", path, quoted), o, n, block, sensitive)
+		}
+		return
+	}
+	// the walk stops here, so the change holds everything below this point, which is masked if any of it is sensitive
+	// (e.g. a set of blocks, or a block that was added, with a password inside)
+	sensitive = sensitive || (block != nil && block.ContainsSensitive())
+	*changes = append(*changes, attributeChange{path: path, old: old, new: new, sensitive: sensitive})
+}
+
+// childSchema returns the schema of an attribute or nested block of block, and whether it's sensitive
+func childSchema(block *configschema.Block, name string) (*configschema.Block, bool) {
+	if block == nil {
+		return nil, false
+	}
+	if a, ok := block.Attributes[name]; ok {
+		// attributes with nested attributes (protocol 6 only) describe their objects like blocks do
+		if a.NestedType != nil {
+			return &configschema.Block{Attributes: a.NestedType.Attributes}, a.Sensitive
+		}
+		return nil, a.Sensitive
+	}
+	if b, ok := block.BlockTypes[name]; ok {
+		return &b.Block, false
+	}
+	return nil, false
+}
+
+func joinAttributePath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,65 @@
+package tfbridge
+
+import (
+	"testing"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestDiffValuesMasksSensitiveSubtrees(t *testing.T) {
+	credentials := configschema.Block{Attributes: map[string]*configschema.Attribute{
+		"username": {Type: cty.String, Optional: true},
+		"password": {Type: cty.String, Optional: true, Sensitive: true},
+	}}
+	block := &configschema.Block{
+		Attributes: map[string]*configschema.Attribute{
+			"name": {Type: cty.String, Required: true},
+			"tags": {Type: cty.Map(cty.String), Optional: true},
+		},
+		BlockTypes: map[string]*configschema.NestedBlock{
+			"user":  {Nesting: configschema.NestingSet, Block: credentials},
+			"admin": {Nesting: configschema.NestingSingle, Block: credentials},
+		},
+	}
+	credentialsType := credentials.ImpliedType()
+	credentialsVal := func(username, password string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{"username": cty.StringVal(username), "password": cty.StringVal(password)})
+	}
+	resource := func(name string, users []cty.Value, admin cty.Value) cty.Value {
+		usersVal := cty.SetValEmpty(credentialsType)
+		if len(users) > 0 {
+			usersVal = cty.SetVal(users)
+		}
+		return cty.ObjectVal(map[string]cty.Value{
+			"name":  cty.StringVal(name),
+			"tags":  cty.MapVal(map[string]cty.Value{"env": cty.StringVal(name)}),
+			"user":  usersVal,
+			"admin": admin,
+		})
+	}
+
+	old := resource("a", []cty.Value{credentialsVal("alice", "hunter2")}, cty.NullVal(credentialsType))
+	new := resource("b", []cty.Value{credentialsVal("alice", "hunter3")}, credentialsVal("root", "toor"))
+
+	want := map[string]bool{`admin`: true, `name`: false, `tags["env"]`: false, `user`: true}
+	changes := diffValues(old, new, block)
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes, want %d: %v", len(changes), len(want), changes)
+	}
+	for _, c := range changes {
+		sensitive, ok := want[c.path]
+		if !ok {
+			t.Errorf("unexpected change at %s", c.path)
+			continue
+		}
+		if c.sensitive != sensitive {
+			t.Errorf("%s: got sensitive %v, want %v", c.path, c.sensitive, sensitive)
+		}
+		oldJSON, _ := c.oldJSON()
+		newJSON, _ := c.newJSON()
+		if sensitive && (oldJSON != sensitiveValue || newJSON != sensitiveValue) {
+			t.Errorf("%s: values aren't masked: %v -> %v", c.path, oldJSON, newJSON)
+		}
+	}
+}
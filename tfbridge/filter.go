@@ -0,0 +1,93 @@
+package tfbridge
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+)
+
+// tableFilter decides which data sources become tables, so that providers with hundreds of data sources (such as
+// AWS) don't have to build all of them
+// Patterns are globs (see path.Match) matched against the data source names, as they appear in the provider's
+// schema (i.e. before any table_prefix is added)
+// Resource types are opt-in, and only become tables if they match some pattern in resources
+type tableFilter struct {
+	include        []string
+	exclude        []string
+	resources      []string
+	skipDeprecated bool
+}
+
+func newTableFilter(config TFBridgeConfig) (*tableFilter, error) {
+	for _, option := range []struct {
+		name     string
+		patterns []string
+	}{{"tables", config.Tables}, {"exclude_tables", config.ExcludeTables}, {"resources", config.Resources}} {
+		for _, p := range option.patterns {
+			// path.Match only reports malformed patterns when it gets to them, so try it against an empty string
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in %s: %w", p, option.name, err)
+			}
+		}
+	}
+
+	return &tableFilter{
+		include:        config.Tables,
+		exclude:        config.ExcludeTables,
+		resources:      config.Resources,
+		skipDeprecated: config.SkipDeprecatedDataSources != nil && *config.SkipDeprecatedDataSources,
+	}, nil
+}
+
+// includes returns true if the data source should be exposed as a table: it must match some pattern in tables
+// (if set) and none of the patterns in exclude_tables
+func (f *tableFilter) includes(name string, schema providers.Schema) bool {
+	if f.skipDeprecated && schema.Block != nil && schema.Block.Deprecated {
+		return false
+	}
+	return f.includesName(name)
+}
+
+func (f *tableFilter) includesName(name string) bool {
+	if len(f.include) > 0 && !matchesAny(f.include, name) {
+		return false
+	}
+	return !matchesAny(f.exclude, name)
+}
+
+// includesAnyName returns true if some data source, resource type or ephemeral resource type of the provider may
+// become a table. It only looks at the names, so it works before the full schema of the provider is read
+func (f *tableFilter) includesAnyName(metadata providers.GetMetadataResponse) bool {
+	for _, names := range [][]string{metadata.DataSources, metadata.EphemeralResourceTypes} {
+		for _, n := range names {
+			if f.includesName(n) {
+				return true
+			}
+		}
+	}
+	for _, n := range metadata.ResourceTypes {
+		if matchesAny(f.resources, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesResource returns true if the resource type should be exposed as a table
+func (f *tableFilter) includesResource(name string, schema providers.Schema) bool {
+	if f.skipDeprecated && schema.Block != nil && schema.Block.Deprecated {
+		return false
+	}
+	return matchesAny(f.resources, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		// patterns were validated on newTableFilter
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package tfbridge
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+)
+
+// tableField is an attribute of a data source, or a nested block that's exposed as a single JSON column
+// Fields inside nested blocks that were flattened (see makeFields) also get their own columns, and path tells
+// how to reach them: the names of the blocks that contain the field, followed by the field's own name
+type tableField struct {
+	path []string
+	// parents are the flattened blocks that contain the field, one for each element of path but the last
+	parents []*configschema.NestedBlock
+	// column is the name of the column, see makeColumnNames
+	column string
+
+	// exactly one of these is set
+	attribute *configschema.Attribute
+	block     *configschema.NestedBlock
+}
+
+// key identifies the field inside the data source, dots can't appear on attribute names
+func (f tableField) key() string {
+	return strings.Join(f.path, ".")
+}
+
+// group returns "required", "optional" or "readonly", like the sections of the Terraform docs
+// A field inside a flattened block is only required if the block itself (and all its parents) are required
+func (f tableField) group() string {
+	parentsRequired := true
+	for _, p := range f.parents {
+		parentsRequired = parentsRequired && childBlockIsRequired(p)
+	}
+
+	var required, optional bool
+	if f.attribute != nil {
+		required, optional = childAttributeIsRequired(f.attribute), childAttributeIsOptional(f.attribute)
+	} else {
+		required, optional = childBlockIsRequired(f.block), childBlockIsOptional(f.block)
+	}
+	switch {
+	case required && parentsRequired:
+		return "required"
+	case required || optional:
+		return "optional"
+	default:
+		return "readonly"
+	}
+}
+
+// isFlattenable returns true for nested blocks that hold at most one object, which can be spread over several columns
+// without losing anything
+func isFlattenable(block *configschema.NestedBlock) bool {
+	switch block.Nesting {
+	case configschema.NestingSingle, configschema.NestingGroup:
+		return true
+	case configschema.NestingList, configschema.NestingSet:
+		return block.MaxItems == 1
+	default:
+		return false
+	}
+}
+
+// makeFields returns the fields of a data source, which become its columns
+// With maxDepth > 0, nested blocks that hold a single object (see isFlattenable) are replaced by their attributes,
+// recursively for up to maxDepth levels of nesting. Blocks that can't be flattened, or are nested too deep, are kept
+// as a single JSON column
+func makeFields(block *configschema.Block, maxDepth int) []tableField {
+	fields := collectFields(block, nil, nil, maxDepth)
+	// sorted, so that anything derived from them doesn't depend on map iteration order
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key() < fields[j].key() })
+	return fields
+}
+
+func collectFields(block *configschema.Block, path []string, parents []*configschema.NestedBlock, maxDepth int) []tableField {
+	fields := make([]tableField, 0, len(block.Attributes)+len(block.BlockTypes))
+	for k, a := range block.Attributes {
+		fields = append(fields, tableField{path: appendCopy(path, k), parents: parents, attribute: a})
+	}
+	for k, b := range block.BlockTypes {
+		if len(parents) < maxDepth && isFlattenable(b) {
+			fields = append(fields, collectFields(&b.Block, appendCopy(path, k), append(parents[:len(parents):len(parents)], b), maxDepth)...)
+			continue
+		}
+		fields = append(fields, tableField{path: appendCopy(path, k), parents: parents, block: b})
+	}
+	return fields
+}
+
+// appendCopy is like append, but never shares the backing array of s, since paths of sibling fields share a prefix
+func appendCopy(s []string, elem string) []string {
+	res := make([]string, len(s), len(s)+1)
+	copy(res, s)
+	return append(res, elem)
+}
@@ -0,0 +1,108 @@
+package tfbridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// Postgres silently truncates identifiers (table and column names) to 63 bytes, so two long data source names that
+// only differ after that point would end up as the same table, and the README's .inspect output shows names that
+// don't match the data sources
+const (
+	maxIdentifierLength = 63
+	// identifierHashLength hex chars of a hash of the full name are kept when shortening, see shortenIdentifier
+	identifierHashLength = 8
+)
+
+// renamedColumnPrefix is prepended to the columns whose attribute name can't be used as is, see makeColumnNames
+const renamedColumnPrefix = "tf_"
+
+// shortenIdentifier returns name unchanged if it fits in a Postgres identifier. Otherwise, it keeps the first
+// 54 bytes of the name and appends an underscore and the first 8 hex chars of the SHA-256 of the full name
+// (e.g. github_actions_organization_oidc_subject_claim_customization_template becomes
+// github_actions_organization_oidc_subject_claim_customi_4f349f35). The hash makes the result deterministic and
+// keeps names that share a long prefix apart
+func shortenIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name))
+	keep := maxIdentifierLength - identifierHashLength - 1
+	return name[:keep] + "_" + hex.EncodeToString(hash[:])[:identifierHashLength]
+}
+
+// makeColumnNames sets the name of the column of each field of a data source
+// Most fields keep their names (joined with underscores, for fields inside flattened blocks), but those that clash
+// with Steampipe's own columns (_ctx and anything that starts with sp_) or with reserved SQL keywords (which would
+// have to be quoted in every query) get the tf_ prefix, and names that are too long are shortened. If the new name
+// is already taken, the prefix is added again until it isn't
+// fields must be sorted (as makeFields does), so that the same schema always gets the same names
+// reserved are the names of extra columns that the table adds, which fields can't use
+func makeColumnNames(fields []tableField, reserved ...string) {
+	taken := map[string]bool{aliasColumnName: true}
+	for _, r := range reserved {
+		taken[r] = true
+	}
+
+	// first the fields that can keep their names, which take precedence over renamed ones
+	// shallower fields go first, so that turning on flatten_nested_blocks never renames top-level attributes
+	order := make([]int, len(fields))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return len(fields[order[i]].parents) < len(fields[order[j]].parents) })
+	for _, i := range order {
+		name := strings.Join(fields[i].path, "_")
+		if !needsRename(name) && !taken[name] {
+			fields[i].column = name
+			taken[name] = true
+		}
+	}
+
+	// then everything else, which includes fields inside flattened blocks whose name clashes with some other field
+	for i, f := range fields {
+		if f.column != "" {
+			continue
+		}
+		column := strings.Join(f.path, "_")
+		// long names only need shortening, the hash already sets them apart
+		if len(column) <= maxIdentifierLength {
+			column = renamedColumnPrefix + column
+		}
+		column = shortenIdentifier(column)
+		for taken[column] {
+			column = shortenIdentifier(renamedColumnPrefix + column)
+		}
+		fields[i].column = column
+		taken[column] = true
+	}
+}
+
+func needsRename(name string) bool {
+	return plugin.IsReservedColumnName(name) || reservedKeywords[name] || len(name) > maxIdentifierLength
+}
+
+// reservedKeywords are the keywords that Postgres lists as reserved (and so can't be used as column names without
+// quoting), see https://www.postgresql.org/docs/current/sql-keywords-appendix.html
+var reservedKeywords = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true, "as": true, "asc": true,
+	"asymmetric": true, "authorization": true, "binary": true, "both": true, "case": true, "cast": true, "check": true,
+	"collate": true, "collation": true, "column": true, "concurrently": true, "constraint": true, "create": true,
+	"cross": true, "current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true, "false": true,
+	"fetch": true, "for": true, "foreign": true, "freeze": true, "from": true, "full": true, "grant": true,
+	"group": true, "having": true, "ilike": true, "in": true, "initially": true, "inner": true, "intersect": true,
+	"into": true, "is": true, "isnull": true, "join": true, "lateral": true, "leading": true, "left": true,
+	"like": true, "limit": true, "localtime": true, "localtimestamp": true, "natural": true, "not": true,
+	"notnull": true, "null": true, "offset": true, "on": true, "only": true, "or": true, "order": true, "outer": true,
+	"overlaps": true, "placing": true, "primary": true, "references": true, "returning": true, "right": true,
+	"select": true, "session_user": true, "similar": true, "some": true, "symmetric": true, "system_user": true,
+	"table": true, "tablesample": true, "then": true, "to": true, "trailing": true, "true": true, "union": true,
+	"unique": true, "user": true, "using": true, "variadic": true, "verbose": true, "when": true, "where": true,
+	"window": true, "with": true,
+}
@@ -0,0 +1,130 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// These defaults are meant to keep large joins (which Steampipe expands into many parallel reads) from tripping
+// the abuse detection of APIs such as GitHub's, while still allowing some parallelism
+const (
+	defaultMaxConcurrency = 10
+	defaultRateLimit      = 10.0
+)
+
+// readLimiter bounds how many data source reads a provider configuration issues at the same time, and how fast it
+// issues them. It's built for each provider block (and alias) of a connection, and shared by all the tables of that
+// configuration, since each one may use its own credentials with separate quotas. The concurrency limit is the
+// exception: it's shared by all the configurations of the connection, see newReadConcurrency
+//
+// NOTE: the SDK's own concurrency limits (HydrateConfig.MaxConcurrency and friends) only apply to column hydrate
+// funcs, and every table here is hydrated by its List func, so limits have to be enforced by the bridge itself
+type readLimiter struct {
+	// concurrency is a semaphore, a slot is taken for as long as a read is in progress. It belongs to the connection
+	concurrency chan struct{}
+
+	// provider is a token bucket shared by all reads, no matter which data source they target
+	provider *rate.Limiter
+
+	// dataSources holds a token bucket for each data source, which are created on first use
+	mu              sync.Mutex
+	dataSources     map[string]*rate.Limiter
+	dataSourceRate  rate.Limit
+	dataSourceBurst int
+}
+
+// newReadConcurrency builds the semaphore that bounds the reads in progress on a connection, no matter which
+// provider configuration they use. It's built once per connection, and passed to newReadLimiter
+func newReadConcurrency(config TFBridgeConfig) (chan struct{}, error) {
+	maxConcurrency := defaultMaxConcurrency
+	if config.MaxConcurrency != nil {
+		maxConcurrency = *config.MaxConcurrency
+	}
+	if maxConcurrency < 1 {
+		return nil, fmt.Errorf("invalid max_concurrency %d: must be at least 1", maxConcurrency)
+	}
+	return make(chan struct{}, maxConcurrency), nil
+}
+
+func newReadLimiter(config TFBridgeConfig, concurrency chan struct{}) (*readLimiter, error) {
+	providerRate, providerBurst, err := parseRateLimitOptions("rate_limit", config.RateLimit, config.RateLimitBurst, defaultRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	dataSourceRate, dataSourceBurst, err := parseRateLimitOptions("data_source_rate_limit", config.DataSourceRateLimit, config.DataSourceRateLimitBurst, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readLimiter{
+		concurrency:     concurrency,
+		provider:        rate.NewLimiter(providerRate, providerBurst),
+		dataSources:     make(map[string]*rate.Limiter),
+		dataSourceRate:  dataSourceRate,
+		dataSourceBurst: dataSourceBurst,
+	}, nil
+}
+
+// wait blocks until a read of the given data source is allowed to start, or ctx is done
+// If it returns no error, the returned func must be called when the read finishes
+func (l *readLimiter) wait(ctx context.Context, dataSource string) (func(), error) {
+	select {
+	case l.concurrency <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-l.concurrency }
+
+	if err := l.provider.Wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	if err := l.dataSource(dataSource).Wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+func (l *readLimiter) dataSource(name string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.dataSources[name]
+	if !ok {
+		limiter = rate.NewLimiter(l.dataSourceRate, l.dataSourceBurst)
+		l.dataSources[name] = limiter
+	}
+	return limiter
+}
+
+// parseRateLimitOptions turns a rate (in reads per second) and a burst size into the parameters of a token bucket
+// A rate of 0 means unlimited. If unset, the burst defaults to the rate (rounded up), so that a full second's
+// worth of reads can start at once
+func parseRateLimitOptions(name string, perSecond *float64, burst *int, def float64) (rate.Limit, int, error) {
+	r := def
+	if perSecond != nil {
+		r = *perSecond
+	}
+	if r < 0 {
+		return 0, 0, fmt.Errorf("invalid %s %v: must not be negative", name, r)
+	}
+	if r == 0 {
+		return rate.Inf, 0, nil
+	}
+
+	b := int(r)
+	if float64(b) < r {
+		b++
+	}
+	if burst != nil {
+		if *burst < 1 {
+			return 0, 0, fmt.Errorf("invalid %s_burst %d: must be at least 1", name, *burst)
+		}
+		b = *burst
+	}
+	return rate.Limit(r), b, nil
+}
@@ -0,0 +1,33 @@
+package tfbridge
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const processLimitsSupported = true
+
+// setProcessLimits applies limits to a running process. They're set right after the provider starts (and before it
+// gets any request), since Go can't set them on the child before it runs
+// Going over the memory limit makes allocations fail, and going over the CPU time limit kills the process, which the
+// pool then treats as a crash
+func setProcessLimits(pid int, limits processLimits) error {
+	for _, l := range []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"memory", unix.RLIMIT_AS, limits.memoryBytes},
+		{"CPU time", unix.RLIMIT_CPU, limits.cpuSeconds},
+		{"open files", unix.RLIMIT_NOFILE, limits.openFiles},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		if err := unix.Prlimit(pid, l.resource, &unix.Rlimit{Cur: l.value, Max: l.value}, nil); err != nil {
+			return fmt.Errorf("setting the %s limit of the provider process: %w", l.name, err)
+		}
+	}
+	return nil
+}
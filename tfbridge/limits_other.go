@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tfbridge
+
+import "errors"
+
+// resource limits are applied with prlimit, which only exists on Linux
+const processLimitsSupported = false
+
+func setProcessLimits(pid int, limits processLimits) error {
+	return errors.New("resource limits are only supported on Linux")
+}
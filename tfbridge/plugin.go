@@ -2,7 +2,12 @@ package tfbridge
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	goplugin "github.com/hashicorp/go-plugin"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
 	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
 	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
 )
@@ -13,7 +18,6 @@ func Plugin(ctx context.Context) *plugin.Plugin {
 		DefaultTransform: transform.FromGo().NullIfZero(),
 		ConnectionConfigSchema: &plugin.ConnectionConfigSchema{
 			NewInstance: ConfigInstance,
-			Schema:      ConfigSchema,
 		},
 		SchemaMode:   plugin.SchemaModeDynamic,
 		TableMapFunc: PluginTables,
@@ -24,50 +28,124 @@ func Plugin(ctx context.Context) *plugin.Plugin {
 type key string
 
 const (
-	keyDataSource key = "dataSource"
-	keySchema     key = "schema"
+	keyDataSource        key = "dataSource"
+	keyResourceType      key = "resourceType"
+	keyEphemeralResource key = "ephemeralResource"
+	keySchema            key = "schema"
 )
 
 func PluginTables(ctx context.Context, d *plugin.TableMapData) (map[string]*plugin.Table, error) {
 	// Initialize tables
 	tables := map[string]*plugin.Table{}
+	// tableOwners maps every table name to the provider configuration that created it, to detect collisions
+	tableOwners := map[string]string{}
+	// every table created from a provider, for the tfbridge_table table
+	var created []providerTable
+	// the resource types on state files of each provider, for the tfbridge_drift table
+	var driftTargets []*driftTarget
+	// every provider configuration, for the tfbridge_provider table
+	var instances []*providerInstance
 
 	config := GetConfig(d.Connection)
-
-	// Download requested provider to tempdir
-	pluginBinaryPath, err := DownloadProvider(ctx, *config.Provider, *config.Version, d)
+	blocks, err := config.GetProviders()
 	if err != nil {
-		plugin.Logger(ctx).Error("tfbridge.PluginTables", "download_provider_error", err, "provider", *config.Provider)
+		plugin.Logger(ctx).Error("tfbridge.PluginTables", "config_error", err)
 		return nil, err
 	}
-	plugin.Logger(ctx).Info("tfbridge.PluginTables", "plugin_download_path", pluginBinaryPath)
-
-	// Establish connection with downloaded provider
-	conn, err := getPluginConnection(pluginBinaryPath)
+	aliasMode, err := config.GetAliasMode()
 	if err != nil {
-		plugin.Logger(ctx).Error("tfbridge.PluginTables", "get_connection_error", err, "provider", *config.Provider)
+		plugin.Logger(ctx).Error("tfbridge.PluginTables", "config_error", err)
 		return nil, err
 	}
-
-	dataSources, err := getDataSources(conn)
+	filter, err := newTableFilter(config)
 	if err != nil {
-		plugin.Logger(ctx).Error("tfbridge.PluginTables", "get_data_sources_error", err)
+		plugin.Logger(ctx).Error("tfbridge.PluginTables", "config_error", err)
 		return nil, err
 	}
-	plugin.Logger(ctx).Debug("tfbridge.PluginTables.getDataSources", "ds", dataSources)
-	for k, i := range dataSources {
-		// Nested WithValue: set two keys on the same context
-		tableCtx := context.WithValue(context.WithValue(ctx, keyDataSource, k), keySchema, i)
-		table, err := tableTFBridge(tableCtx, d.Connection, pluginBinaryPath)
+	// max_concurrency applies to the connection as a whole, see readLimiter
+	concurrency, err := newReadConcurrency(config)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.PluginTables", "config_error", err)
+		return nil, err
+	}
+	// the resource types on the state files decide which state tables exist
+	states, err := loadStateFiles(ctx, config.StateFiles)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.PluginTables", "state_files_error", err)
+		return nil, err
+	}
+
+	// all the configurations (aliases) of a provider are handled together, since they share the binary and schema
+	var names []string
+	configurations := map[string][]ProviderBlock{}
+	for _, provider := range blocks {
+		if _, ok := configurations[provider.Name]; !ok {
+			names = append(names, provider.Name)
+		}
+		configurations[provider.Name] = append(configurations[provider.Name], provider)
+	}
+
+	for _, name := range names {
+		// building the tables is what stalls Steampipe's connection refresh with big providers, so it's timed
+		providerStart := time.Now()
+		providerTables, providerInstances, err := makeProviderTables(ctx, d, config, configurations[name], aliasMode, filter, states, concurrency)
 		if err != nil {
-			plugin.Logger(ctx).Error("tfbridge.PluginTables", "create_table_error", err, "datasource", k)
 			return nil, err
 		}
+		instances = append(instances, providerInstances...)
+		plugin.Logger(ctx).Info("tfbridge.PluginTables.provider", "provider", name, "tables", len(providerTables), "elapsed", time.Since(providerStart))
 
-		plugin.Logger(ctx).Debug("tfbridge.PluginTables.makeTables", "name", k, "table", table)
-		tables[k] = table
+		// all providers share the same schema, so two data sources with the same name (after prefixing) can't coexist
+		for _, t := range providerTables {
+			if owner, ok := tableOwners[t.table.Name]; ok {
+				err := fmt.Errorf("table %s is exposed by both provider %s and provider %s, set table_prefix on one of them", t.table.Name, owner, t.owner)
+				plugin.Logger(ctx).Error("tfbridge.PluginTables", "table_name_collision", err)
+				return nil, err
+			}
+			tableOwners[t.table.Name] = t.owner
+			tables[t.table.Name] = t.table
+			created = append(created, t)
+		}
+
+		var target *driftTarget
+		for _, t := range providerTables {
+			if t.kind != tableKindState {
+				continue
+			}
+			if target == nil {
+				// makeProviderTables already checked that the source parses
+				provider, _ := tfaddr.ParseProviderSource(t.instances[0].Source)
+				target = &driftTarget{provider: provider, instances: t.instances, schemas: map[string]providers.Schema{}}
+				driftTargets = append(driftTargets, target)
+			}
+			target.schemas[t.resourceType] = t.schema
+		}
+	}
+
+	// these are always present, no matter the providers, so aggregators can tell which members have which tables
+	for _, name := range []string{tableInfoTableName, providerInfoTableName} {
+		if owner, ok := tableOwners[name]; ok {
+			err := fmt.Errorf("table %s is exposed by provider %s, but that name is reserved, set table_prefix on that provider", name, owner)
+			plugin.Logger(ctx).Error("tfbridge.PluginTables", "table_name_collision", err)
+			return nil, err
+		}
+	}
+	tables[tableInfoTableName] = tableTFBridgeTable(created)
+	tables[providerInfoTableName] = tableTFBridgeProvider(instances)
+
+	if len(config.StateFiles) > 0 {
+		if owner, ok := tableOwners[driftTableName]; ok {
+			err := fmt.Errorf("table %s is exposed by provider %s, but that name is reserved, set table_prefix on that provider", driftTableName, owner)
+			plugin.Logger(ctx).Error("tfbridge.PluginTables", "table_name_collision", err)
+			return nil, err
+		}
+		tables[driftTableName], err = tableTFBridgeDrift(d.Connection, driftTargets)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.PluginTables", "create_table_error", err, "table", driftTableName)
+			return nil, err
+		}
 	}
-	plugin.Logger(ctx).Debug("tfbridge.PluginTables.makeTables", "tables", tables)
+
 	// paths, err := csvList(ctx, p)
 	// if err != nil {
 	// 	return nil, err
@@ -81,3 +159,293 @@ func PluginTables(ctx context.Context, d *plugin.TableMapData) (map[string]*plug
 
 	return tables, nil
 }
+
+// providerInstance is one configuration of a provider (i.e. a provider block, possibly with an alias), plus
+// everything needed to read data sources with it
+type providerInstance struct {
+	ProviderBlock
+	// connection is the name of the connection, which names the processes that it starts in the logs
+	connection     string
+	pluginLocation string
+	// schemaKey and schemaCacheDir let its processes share the provider's schema, see getPluginConnection
+	schemaKey      string
+	schemaCacheDir string
+	// reattach is set for providers that are already running, see GetReattachProviders
+	reattach *goplugin.ReattachConfig
+	// process are the environment, working directory and limits of its processes
+	process processOptions
+	// processHash, configHash and pool decide which processes of providerProcesses the configuration can use
+	processHash string
+	configHash  string
+	pool        poolOptions
+	// each configuration gets its own rate limits, since they may use different credentials with separate quotas
+	limiter *readLimiter
+}
+
+// providerTable is a table created by makeProviderTables, along with a description of where it came from
+type providerTable struct {
+	table *plugin.Table
+	owner string
+	// kind is one of the tableKind* constants
+	kind string
+	// exactly one of dataSource, resourceType and function is set (ephemeral resource types go in resourceType)
+	dataSource   string
+	resourceType string
+	function     string
+	// schema is the schema of the data source or resource type
+	schema    providers.Schema
+	instances []*providerInstance
+}
+
+const (
+	tableKindDataSource = "data_source"
+	tableKindResource   = "resource"
+	tableKindState      = "state"
+	tableKindFunction   = "function"
+	tableKindEphemeral  = "ephemeral_resource"
+)
+
+// makeProviderTables creates a table for each data source of a single provider
+// configurations holds all the blocks configured for that provider, which differ only in their alias. The provider
+// is downloaded and its schema read only once for all of them
+// With several configurations, aliasMode picks between a single table per data source with an _alias column
+// (aliasModeColumn), or a separate set of tables per configuration, prefixed with its alias (aliasModePrefix)
+// Data sources rejected by filter are skipped before building their tables
+// Every resource type of the provider that appears on states also gets a state table, shared by all configurations
+// Ephemeral resource types go through the same filter as data sources
+// The configurations are returned too, as providerInstances
+func makeProviderTables(ctx context.Context, d *plugin.TableMapData, config TFBridgeConfig, configurations []ProviderBlock, aliasMode string, filter *tableFilter, states []*stateFile, concurrency chan struct{}) (_ []providerTable, _ []*providerInstance, err error) {
+	provider := configurations[0]
+
+	source, err := tfaddr.ParseProviderSource(provider.Source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid provider %q: %w", provider.Source, err)
+	}
+	reattachProviders, err := config.GetReattachProviders()
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "config_error", err)
+		return nil, nil, err
+	}
+
+	var pluginBinaryPath string
+	schemaKey, schemaCacheDir := schemaCacheKey(provider.Source, provider.Version), config.GetSchemaCacheDir()
+	reattach := reattachProviders[source]
+	if reattach != nil {
+		// a provider that's already running (usually under a debugger) is neither downloaded nor started, and its
+		// schema may change every time that it's rebuilt, so it isn't persisted
+		plugin.Logger(ctx).Info("tfbridge.makeProviderTables.reattach", "provider", provider.String(), "addr", reattach.Addr, "pid", reattach.Pid)
+		schemaKey, schemaCacheDir = reattachSchemaKey(provider.Source, reattach), ""
+	} else {
+		// Download requested provider to tempdir
+		pluginBinaryPath, err = DownloadProvider(ctx, provider.Source, provider.Version, d)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "download_provider_error", err, "provider", provider.String())
+			return nil, nil, err
+		}
+		plugin.Logger(ctx).Info("tfbridge.makeProviderTables", "plugin_download_path", pluginBinaryPath, "provider", provider.String())
+	}
+
+	pool, err := newPoolOptions(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	process, err := newProcessOptions(config)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "config_error", err)
+		return nil, nil, err
+	}
+	processHash := process.hash()
+	instances := make([]*providerInstance, 0, len(configurations))
+	for _, c := range configurations {
+		// shared by all tables of the configuration, so that the rate limits apply to the provider as a whole
+		limiter, err := newReadLimiter(config, concurrency)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "read_limiter_error", err)
+			return nil, nil, err
+		}
+		configHash, err := providerConfigHash(c.GetProviderConfig(), c.variables)
+		if err != nil {
+			return nil, nil, fmt.Errorf("provider %q: %w", c.Name, err)
+		}
+		instances = append(instances, &providerInstance{ProviderBlock: c, connection: d.Connection.Name, pluginLocation: pluginBinaryPath, schemaKey: schemaKey, schemaCacheDir: schemaCacheDir, reattach: reattach, process: process, processHash: processHash, configHash: configHash, pool: pool, limiter: limiter})
+	}
+
+	// Get a process of the downloaded provider, only to read its schema. It's left unconfigured, so it can be shared
+	// with other connections that use the same provider version
+	conn, done, err := providerProcesses.acquire(ctx, instances[0], false)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_connection_error", err, "provider", provider.String())
+		return nil, nil, err
+	}
+	// the error tells the pool whether the process crashed, and gets its panic output if it did
+	defer func() { err = done(err) }()
+
+	// the names are enough to tell whether the (much larger) full schema is needed at all, which it isn't for
+	// connections that only use functions, or whose patterns match nothing on this provider
+	metadata, err := getMetadata(ctx, conn)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_metadata_error", err, "provider", provider.String())
+		return nil, nil, err
+	}
+	needsSchema := len(states) > 0 || filter.includesAnyName(metadata)
+	plugin.Logger(ctx).Info("tfbridge.makeProviderTables.metadata", "provider", provider.Name, "data_sources", len(metadata.DataSources), "needs_schema", needsSchema)
+
+	dataSources := map[string]providers.Schema{}
+	if needsSchema {
+		dataSources, err = getDataSources(ctx, conn)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_data_sources_error", err, "provider", provider.String())
+			return nil, nil, err
+		}
+	}
+	included := make(map[string]providers.Schema, len(dataSources))
+	for k, i := range dataSources {
+		if filter.includes(k, i) {
+			included[k] = i
+		}
+	}
+	plugin.Logger(ctx).Info("tfbridge.makeProviderTables.filter", "provider", provider.Name, "data_sources", len(dataSources), "included", len(included))
+
+	// resource types are opt-in (either through resources or through state files), so most connections skip them
+	includedResources := map[string]providers.Schema{}
+	stateResources := map[string]providers.Schema{}
+	if needsSchema && (len(filter.resources) > 0 || len(states) > 0) {
+		resourceTypes, err := getResourceTypes(ctx, conn)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_resource_types_error", err, "provider", provider.String())
+			return nil, nil, err
+		}
+		for k, i := range resourceTypes {
+			if filter.includesResource(k, i) {
+				includedResources[k] = i
+			}
+		}
+		plugin.Logger(ctx).Info("tfbridge.makeProviderTables.filter", "provider", provider.Name, "resource_types", len(resourceTypes), "included", len(includedResources))
+
+		for _, state := range states {
+			for _, r := range state.managedResources(source) {
+				i, ok := resourceTypes[r.Type]
+				if !ok {
+					// e.g. the state was written by a newer version of the provider
+					plugin.Logger(ctx).Warn("tfbridge.makeProviderTables.unknownStateResource", "provider", provider.Name, "type", r.Type, "state", state.location)
+					continue
+				}
+				stateResources[r.Type] = i
+			}
+		}
+		plugin.Logger(ctx).Info("tfbridge.makeProviderTables.states", "provider", provider.Name, "state_resource_types", len(stateResources))
+	}
+
+	ephemeralResources := map[string]providers.Schema{}
+	if needsSchema {
+		ephemeralResources, err = getEphemeralResourceTypes(ctx, conn)
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_ephemeral_resource_types_error", err, "provider", provider.String())
+			return nil, nil, err
+		}
+	}
+	includedEphemeral := make(map[string]providers.Schema, len(ephemeralResources))
+	for k, i := range ephemeralResources {
+		if filter.includes(k, i) {
+			includedEphemeral[k] = i
+		}
+	}
+	plugin.Logger(ctx).Info("tfbridge.makeProviderTables.filter", "provider", provider.Name, "ephemeral_resource_types", len(ephemeralResources), "included", len(includedEphemeral))
+
+	functions, err := getFunctions(ctx, conn)
+	if err != nil {
+		plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "get_functions_error", err, "provider", provider.String())
+		return nil, nil, err
+	}
+	plugin.Logger(ctx).Info("tfbridge.makeProviderTables.functions", "provider", provider.Name, "functions", len(functions))
+
+	// tableSets are the groups of configurations that are exposed through the same tables
+	type tableSet struct {
+		instances []*providerInstance
+		prefix    string
+		owner     string
+	}
+	var sets []tableSet
+	if len(instances) == 1 || aliasMode == aliasModePrefix {
+		for _, i := range instances {
+			prefix := i.GetTablePrefix()
+			if i.TablePrefix == nil && i.Alias != nil && len(instances) > 1 {
+				prefix = *i.Alias + "_"
+			}
+			sets = append(sets, tableSet{instances: []*providerInstance{i}, prefix: prefix, owner: i.Name + "." + i.GetAlias()})
+		}
+	} else {
+		// the unaliased block (if any) acts as the default, like in Terraform, so its prefix is used for the tables
+		prefixFrom := configurations[0]
+		for _, c := range configurations {
+			if c.Alias == nil {
+				prefixFrom = c
+				break
+			}
+		}
+		sets = append(sets, tableSet{instances: instances, prefix: prefixFrom.GetTablePrefix(), owner: provider.Name})
+	}
+
+	var tables []providerTable
+	for _, set := range sets {
+		for k, i := range included {
+			// Nested WithValue: set two keys on the same context
+			tableCtx := context.WithValue(context.WithValue(ctx, keyDataSource, k), keySchema, i)
+			table, err := tableTFBridge(tableCtx, d.Connection, set.instances, config.GetTablePrefix()+set.prefix)
+			if err != nil {
+				plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "create_table_error", err, "datasource", k)
+				return nil, nil, err
+			}
+
+			tables = append(tables, providerTable{table: table, owner: set.owner, kind: tableKindDataSource, dataSource: k, schema: i, instances: set.instances})
+		}
+		for k, i := range includedResources {
+			tableCtx := context.WithValue(context.WithValue(ctx, keyResourceType, k), keySchema, i)
+			table, err := tableTFBridgeResource(tableCtx, d.Connection, set.instances, config.GetTablePrefix()+set.prefix+config.GetResourceTablePrefix())
+			if err != nil {
+				plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "create_table_error", err, "resource", k)
+				return nil, nil, err
+			}
+
+			tables = append(tables, providerTable{table: table, owner: set.owner, kind: tableKindResource, resourceType: k, schema: i, instances: set.instances})
+		}
+		for k, i := range includedEphemeral {
+			tableCtx := context.WithValue(context.WithValue(ctx, keyEphemeralResource, k), keySchema, i)
+			table, err := tableTFBridgeEphemeral(tableCtx, d.Connection, set.instances, config.GetTablePrefix()+set.prefix+config.GetEphemeralTablePrefix())
+			if err != nil {
+				plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "create_table_error", err, "ephemeral_resource", k)
+				return nil, nil, err
+			}
+
+			tables = append(tables, providerTable{table: table, owner: set.owner, kind: tableKindEphemeral, resourceType: k, schema: i, instances: set.instances})
+		}
+	}
+
+	// a state table holds resources from all configurations, each one is refreshed with the configuration that
+	// Terraform used for it, so there's a single set of them even with alias_mode = "prefix"
+	defaultBlock := defaultInstance(instances)
+	for k, i := range stateResources {
+		tableCtx := context.WithValue(context.WithValue(ctx, keyResourceType, k), keySchema, i)
+		table, err := tableTFBridgeState(tableCtx, d.Connection, instances, source, config.GetTablePrefix()+defaultBlock.GetTablePrefix()+config.GetStateTablePrefix())
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "create_table_error", err, "state_resource", k)
+			return nil, nil, err
+		}
+
+		tables = append(tables, providerTable{table: table, owner: provider.Name, kind: tableKindState, resourceType: k, schema: i, instances: instances})
+	}
+
+	// like in Terraform, functions are namespaced by the provider's name and not by its aliases, since they don't
+	// depend on the configuration
+	for k, decl := range functions {
+		table, err := tableTFBridgeFunction(ctx, d.Connection, defaultBlock, k, decl, config.GetTablePrefix()+config.GetFunctionTablePrefix()+provider.Name+"_")
+		if err != nil {
+			plugin.Logger(ctx).Error("tfbridge.makeProviderTables", "create_table_error", err, "function", k)
+			return nil, nil, err
+		}
+
+		tables = append(tables, providerTable{table: table, owner: provider.Name, kind: tableKindFunction, function: k, instances: []*providerInstance{defaultBlock}})
+	}
+
+	return tables, instances, nil
+}
@@ -0,0 +1,560 @@
+package tfbridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/logging"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"google.golang.org/grpc/codes"
+)
+
+// Starting (and configuring) a provider for every read is slow, and a process per read adds up on hosts with many
+// connections, so processes are kept around for a while and shared
+const (
+	defaultProviderIdleTimeout  = 5 * time.Minute
+	defaultMaxProviderProcesses = 20
+)
+
+// A process that crashes is replaced by a new one, but a provider that crashes every time would be restarted by every
+// read. After crashLoopThreshold crashes within crashLoopWindow, no process with that configuration is started for
+// crashLoopCooldown, and reads fail right away instead
+const (
+	crashLoopThreshold = 3
+	crashLoopWindow    = time.Minute
+	crashLoopCooldown  = time.Minute
+	// crashReportTimeout is how long to wait for a process that crashed to exit, so that all its panic output is read
+	crashReportTimeout = 2 * time.Second
+)
+
+// processSeq numbers the processes, so that each one gets its own name in the logs
+var processSeq atomic.Int64
+
+// providerProcesses is shared by all connections of the plugin, so that connections (or aggregator members) that
+// configure the same provider in the same way also share its processes
+var providerProcesses = newProviderPool()
+
+// poolOptions are a connection's settings for providerProcesses
+type poolOptions struct {
+	// idleTimeout is how long a process that no read is using is kept alive, zero closes it right away
+	idleTimeout time.Duration
+	// maxProcesses bounds the processes that are alive at the same time, across all connections. Reads that need a
+	// new process wait for an idle one to be closed, or for a slot to be freed
+	maxProcesses int
+}
+
+func newPoolOptions(config TFBridgeConfig) (poolOptions, error) {
+	idleTimeout, err := parseDurationOption("provider_idle_timeout", config.ProviderIdleTimeout, defaultProviderIdleTimeout)
+	if err != nil {
+		return poolOptions{}, err
+	}
+	maxProcesses := defaultMaxProviderProcesses
+	if config.MaxProviderProcesses != nil {
+		maxProcesses = *config.MaxProviderProcesses
+	}
+	if maxProcesses < 1 {
+		return poolOptions{}, fmt.Errorf("invalid max_provider_processes %d: must be at least 1", maxProcesses)
+	}
+	return poolOptions{idleTimeout: idleTimeout, maxProcesses: maxProcesses}, nil
+}
+
+// providerConfigHash identifies the effective configuration of a provider block: its provider_config, and the
+// values of the variables that it references (which may come from the environment, see loadTerraformDir)
+func providerConfigHash(rawConfig string, variables map[string]cty.Value) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(rawConfig))
+	if len(variables) > 0 {
+		vars := cty.ObjectVal(variables)
+		raw, err := ctyjson.Marshal(vars, vars.Type())
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+		h.Write(raw)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// poolKey identifies the processes that can be shared: same provider and version, same environment and limits (see
+// processOptions), and same configuration. Unconfigured processes (see callProvider) have an empty configHash
+type poolKey struct {
+	schemaKey   string
+	processHash string
+	configHash  string
+}
+
+// poolEntry is a provider process, which may be serving several reads at the same time
+type poolEntry struct {
+	key  poolKey
+	conn providers.Interface
+	// logPrefix names the process in the logs, and finds its panics, see getPluginConnection
+	logPrefix string
+	startedAt time.Time
+	// configureDiags are the diagnostics of configuring the process, if it was configured
+	configureDiags tfdiags.Diagnostics
+	// requests counts the reads that the process got, including those in progress
+	requests int
+	// ready is closed once the process has been started (and configured), err tells whether that worked
+	ready chan struct{}
+	err   error
+	// refs counts the reads that are using the process
+	refs        int
+	lastUsed    time.Time
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	// discarded processes get no new reads, and are closed as soon as the last one is done
+	discarded bool
+	// crashed processes are also discarded, but they count for the crash loop breaker too
+	crashed bool
+	// reattached processes were started by someone else, see GetReattachProviders. They're never closed for being
+	// idle, nor counted against maxProcesses
+	reattached bool
+}
+
+// started returns true if the process has been started (and configured) successfully
+func (e *poolEntry) started() bool {
+	select {
+	case <-e.ready:
+		return e.err == nil
+	default:
+		return false
+	}
+}
+
+// providerPool keeps the provider processes that are alive, see providerProcesses
+type providerPool struct {
+	mu      sync.Mutex
+	entries map[poolKey]*poolEntry
+	// live counts all processes, including those that are starting and those that were discarded but are still used
+	// Reattached providers (see GetReattachProviders) aren't counted, since they weren't started by the pool
+	live int
+	// changed is closed (and replaced) every time that a process is released or closed, to wake up waiting reads
+	changed chan struct{}
+	// crashes are the recent crashes of each configuration, see crashLoopThreshold
+	crashes map[poolKey]*crashHistory
+	// all holds every live process, unlike entries, which only holds those that can get new reads
+	all map[*poolEntry]struct{}
+	// failures is the last failed attempt to start (or configure) a process for each key, until one works
+	failures map[poolKey]startFailure
+}
+
+type startFailure struct {
+	at  time.Time
+	err error
+}
+
+type crashHistory struct {
+	times []time.Time
+	// no new processes are started until then
+	openUntil time.Time
+}
+
+func newProviderPool() *providerPool {
+	return &providerPool{
+		entries:  map[poolKey]*poolEntry{},
+		changed:  make(chan struct{}),
+		crashes:  map[poolKey]*crashHistory{},
+		all:      map[*poolEntry]struct{}{},
+		failures: map[poolKey]startFailure{},
+	}
+}
+
+// acquire returns a process for instance, started (and configured, if configure is set) by this call or shared
+// with other reads. The returned func must be called when the read is done, with the error that it returned, so
+// that processes that crashed aren't handed to other reads. It returns the error that the read should return, which
+// includes the panic output of the provider if it crashed (see providerCrashError)
+func (p *providerPool) acquire(ctx context.Context, instance *providerInstance, configure bool) (providers.Interface, func(error) error, error) {
+	key := poolKey{schemaKey: instance.schemaKey, processHash: instance.processHash}
+	if configure {
+		key.configHash = instance.configHash
+	}
+
+	for {
+		p.mu.Lock()
+		if e, ok := p.entries[key]; ok && !e.discarded {
+			if e.started() && providerExited(e.conn) {
+				// it died while idle, or while serving some other read that hasn't noticed yet
+				p.crashed(e)
+				if e.refs == 0 {
+					if e.idleTimer != nil {
+						e.idleTimer.Stop()
+					}
+					p.close(e)
+				}
+				p.mu.Unlock()
+				plugin.Logger(ctx).Warn("tfbridge.providerPool.acquire.exited", "provider", key.schemaKey, "process", e.logPrefix, "panic", logging.ProviderPanic(e.logPrefix))
+				continue
+			}
+			e.refs++
+			e.requests++
+			if e.idleTimer != nil {
+				e.idleTimer.Stop()
+				e.idleTimer = nil
+			}
+			p.mu.Unlock()
+
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				p.release(e, nil)
+				return nil, nil, ctx.Err()
+			}
+			if e.err != nil {
+				// whoever started it already got the error, this read tries to start its own process
+				p.release(e, nil)
+				continue
+			}
+			return &pooledProvider{Interface: e.conn, pool: p, entry: e}, func(err error) error { return p.release(e, err) }, nil
+		}
+
+		if h := p.crashes[key]; h != nil && time.Now().Before(h.openUntil) {
+			p.mu.Unlock()
+			return nil, nil, fmt.Errorf("the %s provider crashed %d times in less than %s, it won't be started again until %s", key.schemaKey, crashLoopThreshold, crashLoopWindow, h.openUntil.Format(time.RFC3339))
+		}
+
+		if instance.reattach == nil && p.live >= instance.pool.maxProcesses && !p.closeOldestIdle() {
+			// every process is busy, wait until one is released
+			changed, live := p.changed, p.live
+			p.mu.Unlock()
+			plugin.Logger(ctx).Info("tfbridge.providerPool.acquire.wait", "provider", key.schemaKey, "live", live)
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		e := &poolEntry{key: key, logPrefix: fmt.Sprintf("%s.%d.", instance.Name, processSeq.Add(1)), startedAt: time.Now(), ready: make(chan struct{}), refs: 1, requests: 1, idleTimeout: instance.pool.idleTimeout, reattached: instance.reattach != nil}
+		p.entries[key] = e
+		p.all[e] = struct{}{}
+		if !e.reattached {
+			p.live++
+		}
+		p.mu.Unlock()
+
+		plugin.Logger(ctx).Info("tfbridge.providerPool.acquire.start", "provider", key.schemaKey, "process", e.logPrefix, "configure", configure)
+		e.conn, e.configureDiags, e.err = startProvider(ctx, instance, e.logPrefix, configure)
+		close(e.ready)
+		if e.err != nil {
+			p.mu.Lock()
+			p.discard(e)
+			delete(p.all, e)
+			if !e.reattached {
+				p.live--
+			}
+			if isProviderCrash(e.err) {
+				p.recordCrash(key)
+			}
+			// unless the query was cancelled, which says nothing about the provider
+			if ctx.Err() == nil {
+				p.failures[key] = startFailure{at: time.Now(), err: e.err}
+			}
+			p.notify()
+			p.mu.Unlock()
+			return nil, nil, e.err
+		}
+		p.mu.Lock()
+		delete(p.failures, key)
+		p.mu.Unlock()
+		return &pooledProvider{Interface: e.conn, pool: p, entry: e}, func(err error) error { return p.release(e, err) }, nil
+	}
+}
+
+// startProvider starts a new process for instance, and configures it if asked to, returning the diagnostics of
+// configuring it
+func startProvider(ctx context.Context, instance *providerInstance, logPrefix string, configure bool) (_ providers.Interface, _ tfdiags.Diagnostics, err error) {
+	// the diagnostics of configuring it go on its own operation, see configureProvider
+	ctx, op := startOperation(ctx, opStartProcess, sourceAddress(instance.Source), attrConfigure.Bool(configure))
+	defer func() { op.end(err, nil) }()
+
+	conn, err := getPluginConnection(ctx, instance, logPrefix)
+	if err != nil {
+		plugin.Logger(ctx).Warn("tfbridge.startProvider.getPluginConnection", "provider", instance.String(), "err", err)
+		return nil, nil, err
+	}
+	var diags tfdiags.Diagnostics
+	if configure {
+		diags, err = configureProvider(ctx, conn, instance.GetProviderConfig(), instance.variables)
+		if err != nil {
+			plugin.Logger(ctx).Warn("tfbridge.startProvider.configureProvider", "provider", instance.String(), "err", err)
+			if isProviderCrash(err) {
+				waitForExit(conn)
+				err = &providerCrashError{provider: instance.schemaKey, panic: logging.ProviderPanic(logPrefix), err: err}
+			}
+			conn.Close()
+			return nil, diags, err
+		}
+	}
+	return conn, diags, nil
+}
+
+// release is called when a read is done with a process, and returns the error that the read should return
+// Processes that crashed (they exited, or returned an error that means that they're gone) are discarded, and the
+// error gets their panic output. The rest are kept until they have been idle for their idle timeout
+func (p *providerPool) release(e *poolEntry, err error) error {
+	crashed := e.started() && ((err != nil && isProviderCrash(err)) || providerExited(e.conn))
+	if crashed {
+		waitForExit(e.conn)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.refs--
+	e.lastUsed = time.Now()
+	if crashed {
+		p.crashed(e)
+	}
+	if e.refs == 0 && e.started() {
+		switch {
+		case e.discarded || (e.idleTimeout == 0 && !e.reattached):
+			p.discard(e)
+			p.close(e)
+		case e.reattached:
+			// it only costs a connection, and whoever started it decides when it ends
+		default:
+			e.idleTimer = time.AfterFunc(e.idleTimeout, func() {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				if e.refs == 0 && !e.discarded {
+					p.discard(e)
+					p.close(e)
+				}
+			})
+		}
+	}
+	p.notify()
+
+	if crashed && err != nil {
+		return &providerCrashError{provider: e.key.schemaKey, panic: logging.ProviderPanic(e.logPrefix), err: err}
+	}
+	return err
+}
+
+// closeOldestIdle closes the process that has been idle for the longest time, if any, to make room for another
+// Must be called with mu held
+func (p *providerPool) closeOldestIdle() bool {
+	var oldest *poolEntry
+	for _, e := range p.entries {
+		if e.refs == 0 && e.started() && !e.reattached && (oldest == nil || e.lastUsed.Before(oldest.lastUsed)) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	if oldest.idleTimer != nil {
+		oldest.idleTimer.Stop()
+	}
+	p.discard(oldest)
+	p.close(oldest)
+	return true
+}
+
+// discard stops handing a process to new reads. Must be called with mu held
+func (p *providerPool) discard(e *poolEntry) {
+	e.discarded = true
+	if p.entries[e.key] == e {
+		delete(p.entries, e.key)
+	}
+}
+
+// close kills a process that no read is using. Must be called with mu held
+func (p *providerPool) close(e *poolEntry) {
+	delete(p.all, e)
+	if !e.reattached {
+		p.live--
+	}
+	// killing the process may take a while, and it's no longer reachable from the pool anyway. Reattached processes
+	// aren't killed, see parseReattachProviders
+	go e.conn.Close()
+}
+
+// crashed discards a process that crashed, and counts it for the crash loop breaker. Must be called with mu held
+func (p *providerPool) crashed(e *poolEntry) {
+	if e.crashed {
+		return
+	}
+	e.crashed = true
+	p.discard(e)
+	p.recordCrash(e.key)
+}
+
+// recordCrash counts a crash of a process with the given key, and stops starting new ones for a while if they crash
+// too often, see crashLoopThreshold. Must be called with mu held
+func (p *providerPool) recordCrash(key poolKey) {
+	h := p.crashes[key]
+	if h == nil {
+		h = &crashHistory{}
+		p.crashes[key] = h
+	}
+	now := time.Now()
+	recent := h.times[:0]
+	for _, t := range h.times {
+		if now.Sub(t) < crashLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	h.times = append(recent, now)
+	if len(h.times) >= crashLoopThreshold {
+		h.openUntil = now.Add(crashLoopCooldown)
+		h.times = nil
+	}
+}
+
+// stopIfSole discards a process that is about to receive a Stop call, but only if nobody else is using it
+// Must not be called with mu held
+func (p *providerPool) stopIfSole(e *poolEntry) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.refs > 1 {
+		return false
+	}
+	p.discard(e)
+	return true
+}
+
+// notify wakes up the reads that are waiting for a process. Must be called with mu held
+func (p *providerPool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// isProviderCrash returns true for errors that mean that the provider process is gone (gRPC Unavailable)
+func isProviderCrash(err error) bool {
+	for _, diag := range tfdiags.ErrDiagnostics(err) {
+		if extra := tfdiags.ExtraInfo[tfdiags.DiagnosticExtraGRPCStatus](diag); extra != nil && extra.GRPCStatusCode() == codes.Unavailable {
+			return true
+		}
+	}
+	return false
+}
+
+// processStatus describes a process of the pool (or a failed attempt to start one), see tableTFBridgeProvider
+type processStatus struct {
+	key       poolKey
+	logPrefix string
+	// conn is only set for processes that have been started
+	conn           providers.Interface
+	status         string
+	startedAt      time.Time
+	lastUsed       time.Time
+	requests       int
+	activeRequests int
+	configureDiags tfdiags.Diagnostics
+	err            error
+}
+
+const (
+	processStarting = "starting"
+	processIdle     = "idle"
+	processBusy     = "busy"
+	// discarded processes that are still finishing some reads
+	processStopping = "stopping"
+	processCrashed  = "crashed"
+	// the last attempt to start (or configure) a process failed, and there's no process
+	processFailed = "failed"
+)
+
+// status describes every live process, and the last failed attempt to start a process for each key
+func (p *providerPool) status() []processStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var res []processStatus
+	for e := range p.all {
+		st := processStatus{key: e.key, logPrefix: e.logPrefix, startedAt: e.startedAt, lastUsed: e.lastUsed, requests: e.requests, activeRequests: e.refs}
+		switch {
+		case !e.started():
+			st.status = processStarting
+		case e.crashed:
+			st.status = processCrashed
+		case e.discarded:
+			st.status = processStopping
+		case e.refs > 0:
+			st.status = processBusy
+		default:
+			st.status = processIdle
+		}
+		if e.started() {
+			st.conn, st.configureDiags = e.conn, e.configureDiags
+		}
+		res = append(res, st)
+	}
+	for key, f := range p.failures {
+		st := processStatus{key: key, status: processFailed, startedAt: f.at, err: f.err}
+		// the diagnostics of a failed configure are inside the error
+		st.configureDiags = tfdiags.ErrDiagnostics(f.err)
+		res = append(res, st)
+	}
+	return res
+}
+
+// providerExited returns true if the process of conn has exited, which it only does if it crashed (or was closed)
+func providerExited(conn providers.Interface) bool {
+	p, ok := conn.(interface{ Exited() bool })
+	return ok && p.Exited()
+}
+
+// waitForExit waits a bit for the process of conn to exit, so that the panic output is complete
+// The process may have dropped the connection without exiting (yet), so it gives up after crashReportTimeout
+func waitForExit(conn providers.Interface) {
+	if _, ok := conn.(interface{ Exited() bool }); !ok {
+		return
+	}
+	deadline := time.Now().Add(crashReportTimeout)
+	for !providerExited(conn) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// providerCrashError is the error of a read whose provider process crashed, along with the panic output of the
+// provider. It wraps the error that the read returned, so the retry policy still sees it
+type providerCrashError struct {
+	provider string
+	panic    string
+	err      error
+}
+
+func (e *providerCrashError) Error() string {
+	if e.panic == "" {
+		return fmt.Sprintf("the %s provider crashed: %s", e.provider, e.err)
+	}
+	return fmt.Sprintf("the %s provider crashed: %s\n\n%s", e.provider, e.err, e.panic)
+}
+
+func (e *providerCrashError) Unwrap() error {
+	return e.err
+}
+
+// pooledProvider is a process borrowed from the pool, which may be serving other reads at the same time
+type pooledProvider struct {
+	providers.Interface
+	pool  *providerPool
+	entry *poolEntry
+}
+
+// Stop halts everything that the process is doing, including the reads of other queries, and the process can't be
+// used afterwards. Cancelling the RPC is enough to stop the read that asked for it, so the process is only stopped
+// (and then discarded) if no other read is using it
+func (c *pooledProvider) Stop() error {
+	if !c.pool.stopIfSole(c.entry) {
+		return nil
+	}
+	return c.Interface.Stop()
+}
+
+// Close does nothing, the pool closes the process once no read is using it
+func (c *pooledProvider) Close() error {
+	return nil
+}
@@ -0,0 +1,196 @@
+package tfbridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/logging"
+)
+
+// defaultProviderEnvAllowlist are the variables of Steampipe's environment that providers get if the connection
+// doesn't set provider_env_allowlist: enough to find certificates, proxies and the home directory (where providers
+// look for shared credentials files), but no credentials
+var defaultProviderEnvAllowlist = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "TMPDIR", "TMP", "TEMP", "TZ", "LANG", "LC_*",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	// needed to start any process on Windows
+	"SYSTEMROOT", "SystemRoot", "COMSPEC", "PATHEXT", "WINDIR", "APPDATA", "LOCALAPPDATA", "USERPROFILE",
+}
+
+// processOptions are a connection's settings for the provider processes that it starts
+type processOptions struct {
+	// env is the whole environment of the process, as KEY=value pairs (go-plugin adds its own variables)
+	env []string
+	// dir is the working directory, empty to use Steampipe's
+	dir    string
+	limits processLimits
+	// autoMTLS makes go-plugin authenticate both ends of the gRPC connection with throwaway certificates, see
+	// getPluginConnection
+	autoMTLS bool
+	// logLevel is the least severe level of the provider logs that are kept, which is also passed to the provider
+	// as TF_LOG. They go to the Steampipe plugin log, and to logFile if it's set
+	logLevel hclog.Level
+	logFile  *os.File
+}
+
+// processLimits are resource limits applied to each provider process, zero means unlimited. See setProcessLimits
+type processLimits struct {
+	memoryBytes uint64
+	cpuSeconds  uint64
+	openFiles   uint64
+}
+
+func (l processLimits) any() bool {
+	return l.memoryBytes > 0 || l.cpuSeconds > 0 || l.openFiles > 0
+}
+
+func newProcessOptions(config TFBridgeConfig) (processOptions, error) {
+	allowlist := defaultProviderEnvAllowlist
+	if config.ProviderEnvAllowlist != nil {
+		allowlist = config.ProviderEnvAllowlist
+	}
+	for _, p := range allowlist {
+		// path.Match only reports malformed patterns when it gets to them, so try it against an empty string
+		if _, err := path.Match(p, ""); err != nil {
+			return processOptions{}, fmt.Errorf("invalid pattern %q in provider_env_allowlist: %w", p, err)
+		}
+	}
+
+	opts := processOptions{autoMTLS: true, logLevel: hclog.Warn}
+	if config.ProviderAutoMTLS != nil {
+		opts.autoMTLS = *config.ProviderAutoMTLS
+	}
+	if config.ProviderLogLevel != nil {
+		level, err := parseProviderLogLevel(*config.ProviderLogLevel)
+		if err != nil {
+			return processOptions{}, err
+		}
+		opts.logLevel = level
+	} else if level := logging.ProviderLogLevel(); level != hclog.NoLevel {
+		opts.logLevel = level
+	}
+	if config.LogPath != nil && *config.LogPath != "" {
+		f, err := openLogFile(*config.LogPath)
+		if err != nil {
+			return processOptions{}, fmt.Errorf("invalid log_path: %w", err)
+		}
+		opts.logFile = f
+	}
+
+	// the provider only sends logs of the chosen level, unless provider_env says otherwise
+	env := map[string]string{"TF_LOG": strings.ToUpper(opts.logLevel.String())}
+	for name, value := range config.ProviderEnv {
+		env[name] = value
+	}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := env[name]; ok {
+			continue
+		}
+		for _, p := range allowlist {
+			if ok, _ := path.Match(p, name); ok {
+				opts.env = append(opts.env, kv)
+				break
+			}
+		}
+	}
+	for name, value := range env {
+		opts.env = append(opts.env, name+"="+value)
+	}
+	sort.Strings(opts.env)
+
+	if config.ProviderWorkingDir != nil && *config.ProviderWorkingDir != "" {
+		dir, err := filepath.Abs(*config.ProviderWorkingDir)
+		if err != nil {
+			return processOptions{}, fmt.Errorf("invalid provider_working_dir: %w", err)
+		}
+		if info, err := os.Stat(dir); err != nil {
+			return processOptions{}, fmt.Errorf("invalid provider_working_dir: %w", err)
+		} else if !info.IsDir() {
+			return processOptions{}, fmt.Errorf("invalid provider_working_dir %q: not a directory", dir)
+		}
+		opts.dir = dir
+	}
+
+	for _, l := range []struct {
+		name   string
+		value  *int
+		target *uint64
+		scale  uint64
+	}{
+		{"provider_max_memory_mb", config.ProviderMaxMemoryMB, &opts.limits.memoryBytes, 1 << 20},
+		{"provider_max_cpu_seconds", config.ProviderMaxCPUSeconds, &opts.limits.cpuSeconds, 1},
+		{"provider_max_open_files", config.ProviderMaxOpenFiles, &opts.limits.openFiles, 1},
+	} {
+		if l.value == nil {
+			continue
+		}
+		if *l.value < 1 {
+			return processOptions{}, fmt.Errorf("invalid %s %d: must be at least 1", l.name, *l.value)
+		}
+		*l.target = uint64(*l.value) * l.scale
+	}
+	if opts.limits.any() && !processLimitsSupported {
+		return processOptions{}, fmt.Errorf("provider_max_memory_mb, provider_max_cpu_seconds and provider_max_open_files are only supported on Linux")
+	}
+	return opts, nil
+}
+
+// hash identifies the options, so that processes started with different ones aren't shared, see poolKey
+func (o processOptions) hash() string {
+	h := sha256.New()
+	for _, kv := range o.env {
+		h.Write([]byte(kv))
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00%t\x00%s", o.dir, o.limits.memoryBytes, o.limits.cpuSeconds, o.limits.openFiles, o.autoMTLS, o.logLevel)
+	if o.logFile != nil {
+		fmt.Fprintf(h, "\x00%s", o.logFile.Name())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseProviderLogLevel parses provider_log_level, which takes the same levels as TF_LOG
+func parseProviderLogLevel(level string) (hclog.Level, error) {
+	level = strings.ToUpper(level)
+	for _, l := range logging.ValidLevels {
+		if l == level {
+			return hclog.LevelFromString(level), nil
+		}
+	}
+	return hclog.NoLevel, fmt.Errorf("invalid provider_log_level %q, must be one of %s", level, strings.Join(logging.ValidLevels, ", "))
+}
+
+// logFiles are the files of log_path, by absolute path. Like TF_LOG_PATH on Terraform, they're opened once, and
+// kept open for as long as the plugin runs, since the processes that write to them may be shared by many connections
+var logFiles = struct {
+	sync.Mutex
+	m map[string]*os.File
+}{m: map[string]*os.File{}}
+
+func openLogFile(name string) (*os.File, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if f, ok := logFiles.m[name]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	logFiles.m[name] = f
+	return f, nil
+}
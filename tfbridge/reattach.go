@@ -0,0 +1,118 @@
+package tfbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+)
+
+// envReattachProviders is the variable that Terraform reads to use providers that are already running, usually under
+// a debugger (e.g. started with -debug). Its value is printed by the provider when it starts in that mode
+const envReattachProviders = "TF_REATTACH_PROVIDERS"
+
+// reattachDialTimeout bounds the check that a reattached provider is listening, see checkReattachAddr
+const reattachDialTimeout = 5 * time.Second
+
+// GetReattachProviders returns the providers that are already running and must not be downloaded nor started, by
+// their address. They're read from the reattach_providers option, or from TF_REATTACH_PROVIDERS if it's not set
+func (c TFBridgeConfig) GetReattachProviders() (map[tfaddr.Provider]*plugin.ReattachConfig, error) {
+	if c.ReattachProviders != nil {
+		providers, err := parseReattachProviders(*c.ReattachProviders)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reattach_providers: %w", err)
+		}
+		return providers, nil
+	}
+	providers, err := parseReattachProviders(os.Getenv(envReattachProviders))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envReattachProviders, err)
+	}
+	return providers, nil
+}
+
+// This function contains some parts of code that is Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+// see https://github.com/hashicorp/terraform/blob/v1.10.5/main.go#L405
+// parseReattachProviders parses the JSON format of TF_REATTACH_PROVIDERS, which maps provider addresses to where
+// they're listening
+// Unlike in Terraform, all reattach configs are marked as Test, which makes go-plugin leave the process alone when
+// the provider is closed (the process belongs to whoever started it), and trust the protocol version on the config
+func parseReattachProviders(in string) (map[tfaddr.Provider]*plugin.ReattachConfig, error) {
+	unmanagedProviders := map[tfaddr.Provider]*plugin.ReattachConfig{}
+	if in == "" {
+		return unmanagedProviders, nil
+	}
+
+	type reattachConfig struct {
+		Protocol        string
+		ProtocolVersion int
+		Addr            struct {
+			Network string
+			String  string
+		}
+		Pid  int
+		Test bool
+	}
+	var m map[string]reattachConfig
+	err := json.Unmarshal([]byte(in), &m)
+	if err != nil {
+		return nil, err
+	}
+	for p, c := range m {
+		a, err := tfaddr.ParseProviderSource(p)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %q as a provider address: %w", p, err)
+		}
+		var addr net.Addr
+		switch c.Addr.Network {
+		case "unix":
+			addr, err = net.ResolveUnixAddr("unix", c.Addr.String)
+			if err != nil {
+				return nil, fmt.Errorf("invalid unix socket path %q for %q: %w", c.Addr.String, p, err)
+			}
+		case "tcp":
+			addr, err = net.ResolveTCPAddr("tcp", c.Addr.String)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TCP address %q for %q: %w", c.Addr.String, p, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown address type %q for %q", c.Addr.Network, p)
+		}
+		// sdk.v2 providers don't include the protocol version, and they all use protocol 5
+		protocolVersion := c.ProtocolVersion
+		if protocolVersion == 0 {
+			protocolVersion = 5
+		}
+		unmanagedProviders[a] = &plugin.ReattachConfig{
+			Protocol:        plugin.Protocol(c.Protocol),
+			ProtocolVersion: protocolVersion,
+			Pid:             c.Pid,
+			Test:            true,
+			Addr:            addr,
+		}
+	}
+	return unmanagedProviders, nil
+}
+
+// checkReattachAddr checks that a reattached provider is listening, before handing it to go-plugin, which kills the
+// process on the config if it can't connect to it
+func checkReattachAddr(reattach *plugin.ReattachConfig) error {
+	conn, err := net.DialTimeout(reattach.Addr.Network(), reattach.Addr.String(), reattachDialTimeout)
+	if err != nil {
+		return fmt.Errorf("the provider isn't listening on %s (is it still running?): %w", reattach.Addr, err)
+	}
+	return conn.Close()
+}
+
+// reattachSchemaKey identifies a reattached provider instead of schemaCacheKey. The binary behind it may change every
+// time that it's restarted (it's usually being developed), so its schema and tables are only shared while it keeps
+// the same PID
+func reattachSchemaKey(source string, reattach *plugin.ReattachConfig) string {
+	provider, _ := tfaddr.ParseProviderSource(source)
+	return fmt.Sprintf("%s/reattach-%d", provider, reattach.Pid)
+}
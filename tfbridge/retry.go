@@ -0,0 +1,198 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+	"github.com/sethvargo/go-retry"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoff     = "Exponential"
+	defaultRetryInterval    = 500 * time.Millisecond
+	defaultRetryMaxInterval = 30 * time.Second
+)
+
+var validRetryBackoffs = []string{"Constant", "Exponential", "Fibonacci"}
+
+// These matchers are used when the connection sets none of retry_on_summary, retry_on_detail and retry_on_grpc_codes.
+// They try to catch the usual transient failures: rate limits, 5xx responses from the remote API and dropped connections.
+// Unavailable is what a call to a provider process that has crashed returns. Crashed processes are dropped from the
+// pool (see providerPool.release), so retrying it means that the provider is restarted and the read is replayed
+var (
+	defaultRetryOnDetail = []string{
+		`(?i)rate limit`,
+		`(?i)too many requests`,
+		// status codes only count next to HTTP wording, since the same numbers show up in IDs, counts or sizes
+		`(?i)\b(status|http)[^0-9]{0,12}(429|500|502|503|504)\b`,
+		`(?i)\b(500 internal server error|502 bad gateway|503 service unavailable|504 gateway time-?out)\b`,
+		`(?i)connection reset by peer`,
+		`(?i)i/o timeout`,
+	}
+	defaultRetryOnGRPCCodes = []string{"Unavailable", "ResourceExhausted"}
+)
+
+// retryPolicy decides which errors returned while reading a data source are worth retrying, and how
+//
+// NOTE: this can't be delegated to the SDK's ListConfig.RetryConfig, since the SDK only keeps the
+// ShouldRetryError predicate for List hydrate funcs and ignores the attempts and backoff settings
+type retryPolicy struct {
+	maxAttempts int
+	backoff     string
+	interval    time.Duration
+	maxInterval time.Duration
+
+	onSummary   []*regexp.Regexp
+	onDetail    []*regexp.Regexp
+	onGRPCCodes []codes.Code
+}
+
+func newRetryPolicy(config TFBridgeConfig) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		maxAttempts: defaultRetryMaxAttempts,
+		backoff:     defaultRetryBackoff,
+	}
+
+	if config.RetryMaxAttempts != nil {
+		if *config.RetryMaxAttempts < 1 {
+			return nil, fmt.Errorf("invalid retry_max_attempts %d: must be at least 1", *config.RetryMaxAttempts)
+		}
+		policy.maxAttempts = *config.RetryMaxAttempts
+	}
+	if config.RetryBackoff != nil && *config.RetryBackoff != "" {
+		if !slices.Contains(validRetryBackoffs, *config.RetryBackoff) {
+			return nil, fmt.Errorf("invalid retry_backoff %q: must be one of %s", *config.RetryBackoff, strings.Join(validRetryBackoffs, ", "))
+		}
+		policy.backoff = *config.RetryBackoff
+	}
+
+	var err error
+	if policy.interval, err = parseDurationOption("retry_interval", config.RetryInterval, defaultRetryInterval); err != nil {
+		return nil, err
+	}
+	if policy.maxInterval, err = parseDurationOption("retry_max_interval", config.RetryMaxInterval, defaultRetryMaxInterval); err != nil {
+		return nil, err
+	}
+
+	onSummary, onDetail, onGRPCCodes := config.RetryOnSummary, config.RetryOnDetail, config.RetryOnGRPCCodes
+	if onSummary == nil && onDetail == nil && onGRPCCodes == nil {
+		onDetail, onGRPCCodes = defaultRetryOnDetail, defaultRetryOnGRPCCodes
+	}
+	if policy.onSummary, err = compilePatterns("retry_on_summary", onSummary); err != nil {
+		return nil, err
+	}
+	if policy.onDetail, err = compilePatterns("retry_on_detail", onDetail); err != nil {
+		return nil, err
+	}
+	for _, name := range onGRPCCodes {
+		code, err := parseGRPCCode(name)
+		if err != nil {
+			return nil, err
+		}
+		policy.onGRPCCodes = append(policy.onGRPCCodes, code)
+	}
+
+	return policy, nil
+}
+
+// do calls f until it succeeds, it fails with an error that isn't retryable, or the attempts run out
+// f should do all the work required for a single attempt, including getting a provider process, so that a
+// provider process that crashes is replaced by a fresh one on the next attempt
+func (r *retryPolicy) do(ctx context.Context, f func(ctx context.Context) error) error {
+	var backoff retry.Backoff
+	switch r.backoff {
+	case "Constant":
+		backoff = retry.NewConstant(r.interval)
+	case "Fibonacci":
+		backoff = retry.NewFibonacci(r.interval)
+	default:
+		backoff = retry.NewExponential(r.interval)
+	}
+	if r.maxInterval > 0 {
+		backoff = retry.WithCappedDuration(r.maxInterval, backoff)
+	}
+	backoff = retry.WithMaxRetries(uint64(r.maxAttempts-1), backoff)
+
+	attempt := 0
+	return retry.Do(ctx, backoff, func(ctx context.Context) error {
+		attempt++
+		err := f(ctx)
+		// if the query itself was cancelled there's no point in trying again
+		if err != nil && ctx.Err() == nil && r.shouldRetry(err) {
+			plugin.Logger(ctx).Warn("tfbridge.retryPolicy.do", "attempt", attempt, "max_attempts", r.maxAttempts, "err", err)
+			return retry.RetryableError(err)
+		}
+		return err
+	})
+}
+
+// shouldRetry returns true if any error diagnostic contained in err matches any of the configured matchers
+// Errors that didn't come from the provider (e.g. quals that couldn't be converted) are never retried
+func (r *retryPolicy) shouldRetry(err error) bool {
+	for _, diag := range tfdiags.ErrDiagnostics(err) {
+		if diag.Severity() != tfdiags.Error {
+			continue
+		}
+
+		if extra := tfdiags.ExtraInfo[tfdiags.DiagnosticExtraGRPCStatus](diag); extra != nil {
+			if slices.Contains(r.onGRPCCodes, extra.GRPCStatusCode()) {
+				return true
+			}
+		}
+
+		desc := diag.Description()
+		for _, re := range r.onSummary {
+			if re.MatchString(desc.Summary) {
+				return true
+			}
+		}
+		for _, re := range r.onDetail {
+			if re.MatchString(desc.Detail) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compiledPatterns holds every regex compiled by compilePatterns. Each table gets its own retryPolicy, so without it
+// the same few patterns would be compiled again for every table of every connection
+var compiledPatterns sync.Map
+
+func compilePatterns(option string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if re, ok := compiledPatterns.Load(p); ok {
+			compiled = append(compiled, re.(*regexp.Regexp))
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q in %s: %w", p, option, err)
+		}
+		compiledPatterns.Store(p, re)
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// parseGRPCCode accepts both the Go names of gRPC codes ("ResourceExhausted") and the names
+// used in the gRPC docs ("RESOURCE_EXHAUSTED")
+func parseGRPCCode(name string) (codes.Code, error) {
+	normalized := strings.ReplaceAll(name, "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(c.String(), normalized) {
+			return c, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("invalid gRPC status code %q in retry_on_grpc_codes", name)
+}
@@ -0,0 +1,28 @@
+package tfbridge
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDefaultRetryOnDetail(t *testing.T) {
+	cases := map[string]bool{
+		"unexpected response StatusCode: 503":           true,
+		"api error: HTTP 429":                           true,
+		"status code 504 returned by the API":           true,
+		"GET https://example.com: 502 Bad Gateway":      true,
+		"Rate limit exceeded":                           true,
+		"listing failed after 500 items":                false,
+		"instance i-0429500abc not found":               false,
+		"security group sg-504 does not allow port 443": false,
+	}
+	for detail, want := range cases {
+		got := false
+		for _, p := range defaultRetryOnDetail {
+			got = got || regexp.MustCompile(p).MatchString(detail)
+		}
+		if got != want {
+			t.Errorf("%q: got retryable %v, want %v", detail, got, want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package tfbridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// stateFile is the subset of Terraform's state format (version 4, used since Terraform 0.12) that the bridge reads
+// See https://github.com/hashicorp/terraform/blob/main/internal/states/statefile/version4.go
+type stateFile struct {
+	Version   int             `json:"version"`
+	Resources []stateResource `json:"resources"`
+
+	// location is where the state was read from (a path or a URL), it's not part of the file
+	location string
+}
+
+type stateResource struct {
+	Module string `json:"module"`
+	// Mode is "managed" for resources and "data" for data sources, only the former are exposed
+	Mode      string          `json:"mode"`
+	Type      string          `json:"type"`
+	Name      string          `json:"name"`
+	Provider  string          `json:"provider"`
+	Instances []stateInstance `json:"instances"`
+}
+
+type stateInstance struct {
+	// IndexKey is a number (with count) or a string (with for_each), and absent for single instances
+	IndexKey      any    `json:"index_key"`
+	SchemaVersion int64  `json:"schema_version"`
+	Deposed       string `json:"deposed"`
+	// exactly one of these is set, AttributesFlat only on states that were written by Terraform 0.11 and upgraded
+	Attributes     json.RawMessage   `json:"attributes"`
+	AttributesFlat map[string]string `json:"attributes_flat"`
+	// Private is base64 on the file, encoding/json decodes it into the raw bytes that the provider expects
+	Private []byte `json:"private"`
+}
+
+// stateFileVersion is the only state format that the bridge understands
+const stateFileVersion = 4
+
+const resourceModeManaged = "managed"
+
+// stateProviderPattern matches the provider configuration addresses on state files, such as
+// provider["registry.terraform.io/integrations/github"] or module.foo.provider["registry.terraform.io/hashicorp/aws"].west
+var stateProviderPattern = regexp.MustCompile(`^(?:.*\.)?provider\["([^"]+)"\](?:\.([^.]+))?$`)
+
+// parseStateProvider returns the provider and alias (empty for the default configuration) that a resource on a
+// state file was managed with
+func parseStateProvider(config string) (tfaddr.Provider, string, error) {
+	matches := stateProviderPattern.FindStringSubmatch(config)
+	if matches == nil {
+		return tfaddr.Provider{}, "", fmt.Errorf("unsupported provider address %q", config)
+	}
+	provider, err := tfaddr.ParseProviderSource(matches[1])
+	if err != nil {
+		return tfaddr.Provider{}, "", fmt.Errorf("invalid provider address %q: %w", config, err)
+	}
+	return provider, matches[2], nil
+}
+
+// address returns the full address of a resource instance, as shown by `terraform state list`
+func (r stateResource) address(instance stateInstance) string {
+	addr := r.Type + "." + r.Name
+	if r.Module != "" {
+		addr = r.Module + "." + addr
+	}
+	if key := formatIndexKey(instance.IndexKey); key != "" {
+		addr += "[" + key + "]"
+	}
+	return addr
+}
+
+// formatIndexKey returns the index of a resource instance like Terraform writes it, e.g. 0 or "foo"
+func formatIndexKey(key any) string {
+	switch k := key.(type) {
+	case nil:
+		return ""
+	case string:
+		quoted, _ := json.Marshal(k)
+		return string(quoted)
+	case float64:
+		return fmt.Sprintf("%d", int64(k))
+	default:
+		return fmt.Sprint(k)
+	}
+}
+
+// managedResources returns the resources of the given provider on a state file, skipping data sources
+func (s *stateFile) managedResources(provider tfaddr.Provider) []stateResource {
+	var resources []stateResource
+	for _, r := range s.Resources {
+		if r.Mode != resourceModeManaged {
+			continue
+		}
+		p, _, err := parseStateProvider(r.Provider)
+		if err != nil || p != provider {
+			continue
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+// loadStateFiles reads every state file listed on the state_files option
+// Each location is a path, a glob (as understood by filepath.Glob) or a http(s) URL, which is read like Terraform's
+// http backend does: a GET request, with basic auth taken from the URL's user info, if any
+func loadStateFiles(ctx context.Context, locations []string) ([]*stateFile, error) {
+	var states []*stateFile
+	for _, location := range locations {
+		if isStateURL(location) {
+			state, err := fetchStateFile(ctx, location)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+			continue
+		}
+
+		paths, err := filepath.Glob(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state_files pattern %q: %w", location, err)
+		}
+		// a plain path that doesn't match anything is kept, so that reading it reports the missing file
+		if len(paths) == 0 && !strings.ContainsAny(location, "*?[") {
+			paths = []string{location}
+		}
+		for _, path := range paths {
+			state, err := readStateFile(path)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+	}
+	plugin.Logger(ctx).Info("tfbridge.loadStateFiles", "locations", len(locations), "states", len(states))
+	return states, nil
+}
+
+func isStateURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func readStateFile(path string) (*stateFile, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	return parseStateFile(path, contents)
+}
+
+func fetchStateFile(ctx context.Context, location string) (*stateFile, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state_files URL: %w", err)
+	}
+	// the URL may hold a password, which shouldn't end up on errors or logs
+	redacted := u.Redacted()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching state from %s: %w", redacted, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching state from %s: %w", redacted, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	// same as Terraform's http backend, a missing state is an empty one
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent:
+		plugin.Logger(ctx).Warn("tfbridge.fetchStateFile.empty", "location", redacted, "status", resp.StatusCode)
+		return &stateFile{Version: stateFileVersion, location: redacted}, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching state from %s: unexpected status %s", redacted, resp.Status)
+	}
+
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching state from %s: %w", redacted, err)
+	}
+	return parseStateFile(redacted, contents)
+}
+
+func parseStateFile(location string, contents []byte) (*stateFile, error) {
+	state := &stateFile{location: location}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", location, err)
+	}
+	if state.Version != stateFileVersion {
+		return nil, fmt.Errorf("state file %s has format version %d, only version %d (Terraform 0.12 and later) is supported", location, state.Version, stateFileVersion)
+	}
+	return state, nil
+}
@@ -2,169 +2,160 @@ package tfbridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
 	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
 	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
 	"github.com/zclconf/go-cty/cty"
 	"golang.org/x/exp/slices"
+	"golang.org/x/sync/errgroup"
 )
 
-func tableTFBridge(ctx context.Context, connection *plugin.Connection, pluginLocation string) (*plugin.Table, error) {
+// aliasColumnName is the extra column added to tables that merge several configurations of a provider
+// It starts with an underscore so that it can't clash with the attributes of a data source
+const aliasColumnName = "_alias"
+
+// appendAliasColumn adds the _alias column, and an optional key column on it that picks the configurations to read
+// (see targetInstances), to the columns of a table that merges several configurations
+func appendAliasColumn(columns []*plugin.Column, keyColumns plugin.KeyColumnSlice) ([]*plugin.Column, plugin.KeyColumnSlice) {
+	columns = append(columns, &plugin.Column{
+		Name:        aliasColumnName,
+		Type:        proto.ColumnType_STRING,
+		Description: "The alias of the provider configuration that returned this row.",
+		Transform:   FromCtyMapKey(aliasColumnName),
+	})
+	keyColumns = append(keyColumns, &plugin.KeyColumn{
+		Name:      aliasColumnName,
+		Operators: []string{"="},
+		Require:   plugin.Optional,
+	})
+	return columns, keyColumns
+}
+
+// tableTFBridge creates the table for a data source. If instances holds several configurations of the provider,
+// the table returns the rows of all of them, and has an extra _alias column that tells them apart
+func tableTFBridge(ctx context.Context, connection *plugin.Connection, instances []*providerInstance, tablePrefix string) (*plugin.Table, error) {
 	name := ctx.Value(keyDataSource).(string)
 	schema := ctx.Value(keySchema).(providers.Schema)
 
+	config := GetConfig(connection)
+	retries, err := newRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	flattenDepth, err := config.GetFlattenDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	index := tableIndexes.get(tableIndexKey{instances[0].schemaKey, tableKindDataSource, name, flattenDepth}, func() *tableIndex {
+		return newTableIndex(ctx, schema.Block, flattenDepth)
+	})
+	columns, keyColumns := index.newColumns(), index.newKeyColumns()
+	if len(instances) > 1 {
+		columns, keyColumns = appendAliasColumn(columns, keyColumns)
+	}
+
 	return &plugin.Table{
-		Name:        name,
+		Name:        shortenIdentifier(tablePrefix + name),
 		Description: fmt.Sprintf("%s: %s", name, schema.Block.Description),
 		List: &plugin.ListConfig{
-			Hydrate:    ListDataSource(name, pluginLocation),
-			KeyColumns: makeKeyColumns(ctx, schema),
+			Hydrate:    ListDataSource(name, instances, retries, index),
+			KeyColumns: keyColumns,
 		},
-		Columns: makeColumns(ctx, schema),
+		Columns: columns,
 	}, nil
 }
 
-func makeColumns(ctx context.Context, schema providers.Schema) []*plugin.Column {
-	columns := []*plugin.Column{}
-	columnsAttrs := make([]string, 0, len(schema.Block.Attributes))
-	columnsBlocks := make([]string, 0, len(schema.Block.BlockTypes))
-
-	// First the attributes (atomic/leaf params, with no nested business)
-	for k, i := range schema.Block.Attributes {
-		postgresType := attrTypeToColumnType(ctx, i.Type, i.NestedType.ImpliedType())
-		if postgresType == proto.ColumnType_UNKNOWN {
-			plugin.Logger(ctx).Warn("tfbridge.makeColumns.atomic", "msg", "unknown type, skipping column!", "field", k, "type", i.Type)
-			continue
-		}
-		columns = append(columns, &plugin.Column{
-			Name:        k,
-			Type:        postgresType,
-			Description: i.Description,
-			Transform:   FromCtyMapKey(k),
-		})
-		columnsAttrs = append(columnsAttrs, k)
-	}
-
-	// Now the nested blocks, they will be JSON no questions asked
-	for k, i := range schema.Block.BlockTypes {
-		columns = append(columns, &plugin.Column{
-			Name:        k,
-			Type:        proto.ColumnType_JSON,
-			Description: i.Description,
-			Transform:   FromCtyMapKey(k),
-		})
-		columnsBlocks = append(columnsBlocks, k)
-	}
+func makeColumnSpecs(ctx context.Context, fields []tableField) []columnSpec {
+	columns := []columnSpec{}
 
 	// this bit is required for sorting like the TF docs do, see below
 	// colTypes := {"id": "readonly", "name": "required", "type": "optional", "othercol": "readonly", ...}
-	// map keys are the column names, which match datasource's attributes
+	// map keys are the column names, which match datasource's attributes (save for the few renamed ones)
 	// the only valid values are "required", "optional" and "readonly"
 	colTypes := make(map[string]string)
-	for _, col := range columns {
-		var group string
-		if slices.Contains(columnsAttrs, col.Name) { // it's an atomic attr
-			if childAttributeIsRequired(schema.Block.Attributes[col.Name]) {
-				group = "required"
-			} else if childAttributeIsOptional(schema.Block.Attributes[col.Name]) {
-				group = "optional"
-			} else if childAttributeIsReadOnly(schema.Block.Attributes[col.Name]) {
-				group = "readonly"
-			}
-		} else if slices.Contains(columnsBlocks, col.Name) { // it's a nested block (complex attr)
-			if childBlockIsRequired(schema.Block.BlockTypes[col.Name]) {
-				group = "required"
-			} else if childBlockIsOptional(schema.Block.BlockTypes[col.Name]) {
-				group = "optional"
-			} else if childBlockIsReadOnly(schema.Block.BlockTypes[col.Name]) {
-				group = "readonly"
+
+	for _, f := range fields {
+		if f.attribute != nil {
+			// atomic/leaf params, with no nested business
+			postgresType := attrTypeToColumnType(ctx, f.attribute.Type, f.attribute.NestedType.ImpliedType())
+			if postgresType == proto.ColumnType_UNKNOWN {
+				plugin.Logger(ctx).Warn("tfbridge.makeColumnSpecs.atomic", "msg", "unknown type, skipping column!", "field", f.key(), "type", f.attribute.Type)
+				continue
 			}
+			columns = append(columns, columnSpec{
+				name:        f.column,
+				typ:         postgresType,
+				description: f.attribute.Description,
+				transform:   FromCtyMapPath(f.path),
+			})
+		} else {
+			// nested blocks that weren't flattened, they will be JSON no questions asked
+			columns = append(columns, columnSpec{
+				name:        f.column,
+				typ:         proto.ColumnType_JSON,
+				description: f.block.Description,
+				transform:   FromCtyMapPath(f.path),
+			})
 		}
-		if group == "" { // we didn't hit any of the cases above, should be a bug
-			panic(fmt.Errorf("column %v wasn't found on either Attrs or Blocks", col))
-		}
-		colTypes[col.Name] = group
+		colTypes[f.column] = f.group()
 	}
 
 	// as courtesy to the user, sort the columns in required -> optional -> readonly, and inside each group sort alphabetically
 	// this pays no attention to atomic attrs vs. nested/complex attrs
 	sort.SliceStable(columns, func(i, j int) bool {
 		groupOrder := map[string]int{"required": 0, "optional": 1, "readonly": 2}
-		colTypeI, colTypeJ := colTypes[columns[i].Name], colTypes[columns[j].Name]
+		colTypeI, colTypeJ := colTypes[columns[i].name], colTypes[columns[j].name]
 		if colTypeI != colTypeJ {
 			// cols [i] and [j] are on different main groups, so that takes precedence
 			return groupOrder[colTypeI] < groupOrder[colTypeJ]
 		}
 		// otherwise, we know that cols [i] and [j] belong to same group, so we look at their names
-		return columns[i].Name < columns[j].Name
+		return columns[i].name < columns[j].name
 	})
 
 	return columns
 }
 
-func makeKeyColumns(ctx context.Context, schema providers.Schema) plugin.KeyColumnSlice {
+func makeKeyColumnSpecs(ctx context.Context, fields []tableField) []keyColumnSpec {
 	mandatoryKeyColumns := []string{}
 	optionalKeyColumns := []string{}
 
-	for k, i := range schema.Block.Attributes {
-		if childAttributeIsRequired(i) {
-			mandatoryKeyColumns = append(mandatoryKeyColumns, k)
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "mandatory")
-		} else if childAttributeIsOptional(i) {
-			optionalKeyColumns = append(optionalKeyColumns, k)
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "optional")
-		} else if childAttributeIsReadOnly(i) {
+	// Remember that nested blocks that aren't flattened become JSONB columns on Steampipe, and are also quals
+	for _, f := range fields {
+		switch f.group() {
+		case "required":
+			mandatoryKeyColumns = append(mandatoryKeyColumns, f.column)
+		case "optional":
+			optionalKeyColumns = append(optionalKeyColumns, f.column)
+		default:
 			// Read-only attrs don't become KeyColumns
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "ignore")
-		} else {
-			// should never happen, right?
-			plugin.Logger(ctx).Error("makeKeyColumns", "column", k, "data", i, "disposition", "INVALID")
 		}
 	}
 
-	// Remember that all nested blocks become JSONB columns on Steampipe, no matter what
-	for k, i := range schema.Block.BlockTypes {
-		if childBlockIsRequired(i) {
-			mandatoryKeyColumns = append(mandatoryKeyColumns, k)
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "mandatory")
-		} else if childBlockIsOptional(i) {
-			optionalKeyColumns = append(optionalKeyColumns, k)
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "optional")
-		} else if childBlockIsReadOnly(i) {
-			// Read-only nested blocks don't become KeyColumns
-			plugin.Logger(ctx).Debug("makeKeyColumns", "column", k, "data", i, "disposition", "ignore")
-		} else {
-			// should never happen, right?
-			plugin.Logger(ctx).Error("makeKeyColumns", "column", k, "data", i, "disposition", "INVALID")
-		}
-	}
+	// the order must be stable: aggregator connections compare the key columns of their members in order, and
+	// exclude the table if they differ (and map iteration order is random, even for identical schemas)
+	sort.Strings(mandatoryKeyColumns)
+	sort.Strings(optionalKeyColumns)
 
-	var all = make([]*plugin.KeyColumn, 0, len(mandatoryKeyColumns)+len(optionalKeyColumns))
+	var all = make([]keyColumnSpec, 0, len(mandatoryKeyColumns)+len(optionalKeyColumns))
 	for _, c := range mandatoryKeyColumns {
-		all = append(all, &plugin.KeyColumn{
-			Name:      c,
-			Operators: []string{"="},
-			Require:   plugin.Required, // Magic is here
-		})
+		all = append(all, keyColumnSpec{name: c, require: plugin.Required}) // Magic is here
 	}
 	for _, c := range optionalKeyColumns {
-		all = append(all, &plugin.KeyColumn{
-			Name:      c,
-			Operators: []string{"="},
-			Require:   plugin.Optional, // Magic is here
-		})
+		all = append(all, keyColumnSpec{name: c, require: plugin.Optional}) // Magic is here
 	}
 
-	plugin.Logger(ctx).Info("makeKeyColumns.done", "len", len(all), "mand", mandatoryKeyColumns, "opt", optionalKeyColumns, "val", all)
 	return all
 }
 
 func attrTypeToColumnType(ctx context.Context, attrType cty.Type, nestedAttrType cty.Type) proto.ColumnType {
-	plugin.Logger(ctx).Debug("tfbridge.attrTypeToColumnType", "type", attrType)
-
 	switch attrType {
 	case cty.Number:
 		return proto.ColumnType_DOUBLE
@@ -182,37 +173,152 @@ func attrTypeToColumnType(ctx context.Context, attrType cty.Type, nestedAttrType
 		// fear the unknown, cast as JSON
 		// this catches tuple, list, set (array-likes), object, map (dict-likes) and probably others?
 		// plz no capsule types
-		plugin.Logger(ctx).Warn("tfbridge.attrTypeToColumnType", "unknown_type_on_attr", attrType.FriendlyName())
+		// not a Warn, since this happens for every list, map and object attribute of every table
+		plugin.Logger(ctx).Debug("tfbridge.attrTypeToColumnType", "unknown_type_on_attr", attrType.FriendlyName())
 		return proto.ColumnType_JSON
 	}
 }
 
-func ListDataSource(name, pluginLocation string) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+func ListDataSource(name string, instances []*providerInstance, retries *retryPolicy, index *tableIndex) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
 	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
 		config := GetConfig(d.Connection)
 
-		plugin.Logger(ctx).Info("tfbridge.ListDataSource", "equalsQuals", d.EqualsQuals)
-		plugin.Logger(ctx).Info("tfbridge.ListDataSource", "location", pluginLocation)
-		conn, err := getPluginConnection(pluginLocation)
+		// the quals may hold secrets, qualsToConfig logs the names of their columns
+		plugin.Logger(ctx).Info("tfbridge.ListDataSource", "data_source", name)
+		timeout, err := config.GetReadTimeout()
 		if err != nil {
-			plugin.Logger(ctx).Warn("tfbridge.ListDataSource.getPluginConnection", "provider", *config.Provider, "err", err)
 			return nil, err
 		}
-		err = configureProvider(ctx, conn, *config.ProviderConfig)
-		if err != nil {
-			plugin.Logger(ctx).Warn("tfbridge.ListDataSource.configureProvider", "provider", *config.Provider, "config", config.ProviderConfig, "err", err)
-			return nil, err
+
+		return nil, streamFromInstances(ctx, d, instances, func(ctx context.Context, instance *providerInstance) ([]map[string]cty.Value, error) {
+			var response *cty.Value
+			err := callProvider(ctx, "data source "+name, name, instance, true, retries, timeout, func(ctx context.Context, conn providers.Interface) error {
+				var err error
+				response, err = readDataSource(ctx, conn, name, d.EqualsQuals, index)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			return []map[string]cty.Value{response.AsValueMap()}, nil
+		})
+	}
+}
+
+// targetInstances returns the configurations of the provider that a query should read: those asked for in the
+// _alias qual, or all of them if absent
+func targetInstances(d *plugin.QueryData, instances []*providerInstance) []*providerInstance {
+	if len(instances) == 1 {
+		return instances
+	}
+	qual, ok := d.EqualsQuals[aliasColumnName]
+	if !ok {
+		return instances
+	}
+
+	aliases := []string{qual.GetStringValue()}
+	if list := qual.GetListValue(); list != nil {
+		aliases = aliases[:0]
+		for _, v := range list.Values {
+			aliases = append(aliases, v.GetStringValue())
+		}
+	}
+	var targets []*providerInstance
+	for _, i := range instances {
+		if slices.Contains(aliases, i.GetAlias()) {
+			targets = append(targets, i)
 		}
+	}
+	return targets
+}
+
+// streamFromInstances calls read for every configuration of the provider targeted by the query, and streams the
+// rows that it returns. If the table merges several configurations, rows get the _alias column too
+func streamFromInstances(ctx context.Context, d *plugin.QueryData, instances []*providerInstance, read func(ctx context.Context, instance *providerInstance) ([]map[string]cty.Value, error)) error {
+	// the configurations are independent (different credentials, different limits), so read them in parallel
+	// StreamListItem isn't safe for concurrent use, so the reads run in parallel but rows are streamed one at a time
+	var streamMu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	for _, instance := range targetInstances(d, instances) {
+		instance := instance
+		g.Go(func() error {
+			rows, err := read(gctx, instance)
+			if err != nil {
+				return err
+			}
 
-		response, err := readDataSource(ctx, conn, name, d.EqualsQuals)
+			streamMu.Lock()
+			defer streamMu.Unlock()
+			for _, row := range rows {
+				if len(instances) > 1 {
+					if row == nil {
+						row = map[string]cty.Value{}
+					}
+					row[aliasColumnName] = cty.StringVal(instance.GetAlias())
+				}
+				d.StreamListItem(ctx, row)
+			}
+			// rows may hold sensitive attributes, so only how many there were is logged
+			plugin.Logger(ctx).Info("tfbridge.streamFromInstances.rows", "alias", instance.GetAlias(), "rows", len(rows))
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// callProvider gets a provider process with a single configuration, and calls f with it, applying the connection's
+// limits, timeout and retry policy. Processes come from providerProcesses, so they may be shared with other reads
+// what describes the call for errors (e.g. "data source github_repository"), and name is the data source or
+// resource type, which is used for the per-table rate limits
+// If configure is false, the provider is left unconfigured, which is enough for calls that don't reach the remote
+// API (such as UpgradeResourceState) and doesn't need any credentials
+func callProvider(ctx context.Context, what, name string, instance *providerInstance, configure bool, retries *retryPolicy, timeout time.Duration, f func(ctx context.Context, conn providers.Interface) error) error {
+	plugin.Logger(ctx).Info("tfbridge.callProvider", "location", instance.pluginLocation, "provider", instance.String(), "what", what)
+
+	// a process that crashed is dropped from the pool when its read is done, so the next attempt gets a fresh one
+	return retries.do(ctx, func(ctx context.Context) error {
+		// retries also count against the limits, since they also hit the remote API
+		release, err := instance.limiter.wait(ctx, name)
 		if err != nil {
-			plugin.Logger(ctx).Warn("tfbridge.ListDataSource.readDataSource", "name", name)
-			return nil, err
+			return err
 		}
-		responseMap := response.AsValueMap()
-		plugin.Logger(ctx).Info("tfbridge.ListDataSource.response", "data", responseMap)
-		d.StreamListItem(ctx, responseMap)
+		defer release()
 
-		return nil, nil
+		err = callProviderOnce(ctx, what, instance, configure, timeout, f)
+		// a provider that crashed is restarted (and configured again) right away, even if retries are disabled, since
+		// the crash doesn't say anything about the read. Providers that keep crashing are stopped by the pool
+		var crash *providerCrashError
+		if errors.As(err, &crash) && ctx.Err() == nil {
+			plugin.Logger(ctx).Warn("tfbridge.callProvider.restart", "what", what, "provider", instance.String(), "err", err)
+			err = callProviderOnce(ctx, what, instance, configure, timeout, f)
+		}
+		return err
+	})
+}
+
+// callProviderOnce gets a process from the pool and calls f with it, see callProvider
+func callProviderOnce(ctx context.Context, what string, instance *providerInstance, configure bool, timeout time.Duration, f func(ctx context.Context, conn providers.Interface) error) (err error) {
+	conn, done, err := providerProcesses.acquire(ctx, instance, configure)
+	if err != nil {
+		return err
+	}
+	// the error tells the pool whether the process crashed, and gets its panic output if it did
+	defer func() { err = done(err) }()
+
+	callCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err = f(callCtx, conn)
+	if err != nil {
+		// only blame the timeout if it was ours, and not the query being cancelled from outside
+		if errors.Is(callCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("reading %s timed out after %s (see the read_timeout connection option)", what, timeout)
+		}
+		plugin.Logger(ctx).Warn("tfbridge.callProvider", "what", what, "err", err)
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,143 @@
+package tfbridge
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+// columnSpec is what the index keeps of a column: enough to create its plugin.Column, but no pointers into the schema
+type columnSpec struct {
+	name        string
+	typ         proto.ColumnType
+	description string
+	// transform reads the value from the row, see FromCtyMapPath. It's never changed after being built, so all the
+	// columns materialized from the spec share it
+	transform *transform.ColumnTransforms
+}
+
+// keyColumnSpec is what the index keeps of a key column, require is plugin.Required or plugin.Optional
+type keyColumnSpec struct {
+	name    string
+	require string
+}
+
+// tableIndex is the compact description of the table of a data source (or resource type, state resource type,
+// ephemeral resource type or function)
+// Walking the schema of a type adds up with providers that have hundreds of them (such as AWS or Azure), so it's
+// done once per provider version, the first time that some connection needs the type, and only the columns are kept
+// Each connection still materializes its own plugin.Column and plugin.KeyColumn values from it when it creates the
+// table, since the SDK may change them, and it needs the columns of every table when the connection is set up to
+// build its schema. Only the fields, which are needed to turn quals into a configuration, wait until the first read,
+// see getFields
+type tableIndex struct {
+	flattenDepth int
+	reserved     []string
+	columns      []columnSpec
+	keyColumns   []keyColumnSpec
+
+	fieldsOnce sync.Once
+	fields     []tableField
+}
+
+// tableIndexKey identifies a tableIndex. The table kind and flattening change the columns, so they're part of it too
+type tableIndexKey struct {
+	// schemaKey identifies the provider and version, see schemaCacheKey
+	schemaKey    string
+	kind         string
+	typeName     string
+	flattenDepth int
+}
+
+// tableIndexes is shared by all connections of the plugin. It only grows, but it only holds the types that some
+// connection turned into tables, which are bounded by the provider versions in use
+var tableIndexes = &tableIndexCache{entries: map[tableIndexKey]*tableIndexEntry{}}
+
+type tableIndexCache struct {
+	mu      sync.Mutex
+	entries map[tableIndexKey]*tableIndexEntry
+}
+
+type tableIndexEntry struct {
+	once  sync.Once
+	index *tableIndex
+}
+
+// get returns the tableIndex for key, calling build if no connection has built it yet
+func (c *tableIndexCache) get(key tableIndexKey, build func() *tableIndex) *tableIndex {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &tableIndexEntry{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+	// concurrent connections wait for the first one to finish, instead of building the same thing in parallel
+	entry.once.Do(func() { entry.index = build() })
+	return entry.index
+}
+
+// newTableIndex builds the tableIndex of a type whose schema is block. reserved are the names of the extra columns
+// that the table adds, see makeColumnNames
+func newTableIndex(ctx context.Context, block *configschema.Block, flattenDepth int, reserved ...string) *tableIndex {
+	// column names may differ from attribute names, see makeColumnNames
+	fields := makeFields(block, flattenDepth)
+	makeColumnNames(fields, reserved...)
+	// the fields are dropped here, the columns are all that connection setup needs
+	return &tableIndex{
+		flattenDepth: flattenDepth,
+		reserved:     reserved,
+		columns:      makeColumnSpecs(ctx, fields),
+		keyColumns:   makeKeyColumnSpecs(ctx, fields),
+	}
+}
+
+// newColumns materializes the columns of the table
+func (t *tableIndex) newColumns() []*plugin.Column {
+	return materializeColumns(t.columns)
+}
+
+// newKeyColumns materializes the key columns of the table
+func (t *tableIndex) newKeyColumns() plugin.KeyColumnSlice {
+	return materializeKeyColumns(t.keyColumns)
+}
+
+// getFields returns the fields of the table, building them from block the first time. block must be the schema that
+// the index was built from, which reads get from the provider anyway. Function indexes have them from the start (see
+// newFunctionIndex), so block may be nil for those
+func (t *tableIndex) getFields(block *configschema.Block) []tableField {
+	t.fieldsOnce.Do(func() {
+		t.fields = makeFields(block, t.flattenDepth)
+		makeColumnNames(t.fields, t.reserved...)
+	})
+	return t.fields
+}
+
+func materializeColumns(specs []columnSpec) []*plugin.Column {
+	columns := make([]*plugin.Column, 0, len(specs))
+	for _, s := range specs {
+		columns = append(columns, &plugin.Column{
+			Name:        s.name,
+			Type:        s.typ,
+			Description: s.description,
+			Transform:   s.transform,
+		})
+	}
+	return columns
+}
+
+func materializeKeyColumns(specs []keyColumnSpec) plugin.KeyColumnSlice {
+	keyColumns := make(plugin.KeyColumnSlice, 0, len(specs))
+	for _, s := range specs {
+		keyColumns = append(keyColumns, &plugin.KeyColumn{
+			Name:      s.name,
+			Operators: []string{"="},
+			Require:   s.require,
+		})
+	}
+	return keyColumns
+}
@@ -0,0 +1,186 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+	convert5 "github.com/jreyesr/steampipe-plugin-tfbridge/plugin/convert"
+	convert6 "github.com/jreyesr/steampipe-plugin-tfbridge/plugin6/convert"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfplugin5"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfplugin6"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/context_key"
+	"github.com/zclconf/go-cty/cty"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// BenchmarkProviderTables builds the data source tables of a big provider, like PluginTables does on connection
+// setup. first_connection starts from an empty index (a new provider version), next_connection reuses it (more
+// connections of the same provider, or aggregator members)
+// The schema is a synthetic one about the size of the AWS provider's. To use a real one, point TFBRIDGE_BENCH_SCHEMA
+// to a schema recorded on schema_cache_dir (a schema.tfplugin5.pb or schema.tfplugin6.pb file)
+func BenchmarkProviderTables(b *testing.B) {
+	dataSources := syntheticDataSources(700)
+	if path := os.Getenv("TFBRIDGE_BENCH_SCHEMA"); path != "" {
+		var err error
+		if dataSources, err = readRecordedDataSources(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), context_key.Logger, hclog.NewNullLogger())
+	connection := &plugin.Connection{Name: "bench", Config: TFBridgeConfig{}}
+	instances := []*providerInstance{{schemaKey: "registry.terraform.io/hashicorp/bench/1.0.0"}}
+	build := func(b *testing.B) {
+		for k, i := range dataSources {
+			tableCtx := context.WithValue(context.WithValue(ctx, keyDataSource, k), keySchema, i)
+			if _, err := tableTFBridge(tableCtx, connection, instances, "bench_"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	original := tableIndexes
+	defer func() { tableIndexes = original }()
+
+	b.Run("first_connection", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			tableIndexes = &tableIndexCache{entries: map[tableIndexKey]*tableIndexEntry{}}
+			build(b)
+		}
+	})
+	b.Run("next_connection", func(b *testing.B) {
+		tableIndexes = &tableIndexCache{entries: map[tableIndexKey]*tableIndexEntry{}}
+		build(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			build(b)
+		}
+	})
+}
+
+func TestTableIndexSharedByConnections(t *testing.T) {
+	original := tableIndexes
+	defer func() { tableIndexes = original }()
+	tableIndexes = &tableIndexCache{entries: map[tableIndexKey]*tableIndexEntry{}}
+
+	ctx := context.WithValue(context.Background(), context_key.Logger, hclog.NewNullLogger())
+	var schema providers.Schema
+	for _, s := range syntheticDataSources(1) {
+		schema = s
+	}
+	tableCtx := context.WithValue(context.WithValue(ctx, keyDataSource, "bench_data_source"), keySchema, schema)
+	build := func(connection, schemaKey string) *plugin.Table {
+		instances := []*providerInstance{{connection: connection, schemaKey: schemaKey}}
+		table, err := tableTFBridge(tableCtx, &plugin.Connection{Name: connection, Config: TFBridgeConfig{}}, instances, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return table
+	}
+
+	first := build("first", "registry.terraform.io/hashicorp/bench/1.0.0")
+	second := build("second", "registry.terraform.io/hashicorp/bench/1.0.0")
+	if len(tableIndexes.entries) != 1 {
+		t.Fatalf("two connections with the same provider version built %d indexes, want 1", len(tableIndexes.entries))
+	}
+	for _, entry := range tableIndexes.entries {
+		if entry.index.fields != nil {
+			t.Errorf("fields were built before the first read")
+		}
+	}
+
+	// each connection gets its own columns, since the SDK may change them
+	if len(first.Columns) != len(second.Columns) || len(first.Columns) == 0 {
+		t.Fatalf("got %d and %d columns", len(first.Columns), len(second.Columns))
+	}
+	for i := range first.Columns {
+		if first.Columns[i] == second.Columns[i] {
+			t.Errorf("column %s is shared between connections", first.Columns[i].Name)
+		}
+		if first.Columns[i].Name != second.Columns[i].Name {
+			t.Errorf("column %d is %s on one connection and %s on the other", i, first.Columns[i].Name, second.Columns[i].Name)
+		}
+	}
+
+	build("third", "registry.terraform.io/hashicorp/bench/2.0.0")
+	if len(tableIndexes.entries) != 2 {
+		t.Fatalf("another provider version built %d indexes in total, want 2", len(tableIndexes.entries))
+	}
+}
+
+// syntheticDataSources returns n data source schemas shaped like those of big providers: a few arguments, lots of
+// computed attributes, and nested blocks of several kinds, all with descriptions
+func syntheticDataSources(n int) map[string]providers.Schema {
+	description := strings.Repeat("Lorem ipsum dolor sit amet. ", 4)
+	types := []cty.Type{cty.String, cty.Number, cty.Bool, cty.List(cty.String), cty.Map(cty.String)}
+	attributes := func(count int, arguments int) map[string]*configschema.Attribute {
+		attrs := make(map[string]*configschema.Attribute, count)
+		for i := 0; i < count; i++ {
+			attr := &configschema.Attribute{Type: types[i%len(types)], Description: description}
+			switch {
+			case i == 0:
+				attr.Required = true
+			case i < arguments:
+				attr.Optional = true
+			default:
+				attr.Computed = true
+			}
+			attrs[fmt.Sprintf("attribute_%d", i)] = attr
+		}
+		return attrs
+	}
+
+	schemas := make(map[string]providers.Schema, n)
+	for i := 0; i < n; i++ {
+		schemas[fmt.Sprintf("bench_data_source_%d", i)] = providers.Schema{Block: &configschema.Block{
+			Attributes: attributes(30, 4),
+			BlockTypes: map[string]*configschema.NestedBlock{
+				"filter": {Nesting: configschema.NestingSet, Block: configschema.Block{Attributes: attributes(2, 2), Description: description}},
+				"config": {Nesting: configschema.NestingList, MaxItems: 1, Block: configschema.Block{Attributes: attributes(8, 0), Description: description}},
+				"tags":   {Nesting: configschema.NestingList, Block: configschema.Block{Attributes: attributes(4, 0), Description: description}},
+			},
+			Description: description,
+		}}
+	}
+	return schemas
+}
+
+// readRecordedDataSources reads the data source schemas of a file written by providers.WriteSchemaFile
+func readRecordedDataSources(path string) (map[string]providers.Schema, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := map[string]providers.Schema{}
+	switch {
+	case strings.HasSuffix(path, ".tfplugin5.pb"):
+		resp := new(tfplugin5.GetProviderSchema_Response)
+		if err := protobuf.Unmarshal(raw, resp); err != nil {
+			return nil, err
+		}
+		for k, s := range resp.DataSourceSchemas {
+			schemas[k] = convert5.ProtoToProviderSchema(s)
+		}
+	case strings.HasSuffix(path, ".tfplugin6.pb"):
+		resp := new(tfplugin6.GetProviderSchema_Response)
+		if err := protobuf.Unmarshal(raw, resp); err != nil {
+			return nil, err
+		}
+		for k, s := range resp.DataSourceSchemas {
+			schemas[k] = convert6.ProtoToProviderSchema(s)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a recorded schema, see providers.SchemaFile", path)
+	}
+	return schemas, nil
+}
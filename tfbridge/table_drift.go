@@ -0,0 +1,159 @@
+package tfbridge
+
+import (
+	"context"
+
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+// driftTableName is the name of the table that compares the state files with the remote system
+const driftTableName = "tfbridge_drift"
+
+const (
+	// driftChangeUpdate is an attribute whose value changed outside Terraform
+	driftChangeUpdate = "update"
+	// driftChangeDelete is a resource that no longer exists
+	driftChangeDelete = "delete"
+)
+
+// driftTarget holds what the drift table needs to read the resources of a provider from the state files
+type driftTarget struct {
+	provider  tfaddr.Provider
+	instances []*providerInstance
+	// schemas holds the resource types of the provider that appear on the state files
+	schemas map[string]providers.Schema
+}
+
+// driftRow is a difference between a state file and the remote system, see tableTFBridgeDrift
+// The field names match the column names, so the default transform (FromGo) picks them up
+type driftRow struct {
+	StateFile    string
+	Address      string
+	ResourceType string
+	Provider     string
+	Change       string
+	Path         string
+	OldValue     any
+	NewValue     any
+	Sensitive    bool
+}
+
+// tableTFBridgeDrift creates a table that reports the resources on the state files whose attributes were changed
+// outside Terraform, like `terraform plan -refresh-only` does, but without needing the Terraform configuration
+// Every resource instance on the state files is read again with ReadResource (with the provider configuration that
+// manages it), and each attribute that differs from the (upgraded) value on the state becomes a row. Resources that
+// no longer exist become a single row, with no path
+func tableTFBridgeDrift(connection *plugin.Connection, targets []*driftTarget) (*plugin.Table, error) {
+	retries, err := newRetryPolicy(GetConfig(connection))
+	if err != nil {
+		return nil, err
+	}
+
+	return &plugin.Table{
+		Name:        driftTableName,
+		Description: "Attributes of the resources on the Terraform state files that differ from the remote system.",
+		List: &plugin.ListConfig{
+			Hydrate: ListDrift(targets, retries),
+			// these are filtered before any call to the provider, which is the slow part
+			KeyColumns: plugin.KeyColumnSlice{
+				{Name: "address", Operators: []string{"="}, Require: plugin.Optional},
+				{Name: "state_file", Operators: []string{"="}, Require: plugin.Optional},
+				{Name: "resource_type", Operators: []string{"="}, Require: plugin.Optional},
+			},
+		},
+		Columns: []*plugin.Column{
+			{Name: "state_file", Type: proto.ColumnType_STRING, Description: "The state file (path or URL) that holds the resource."},
+			{Name: "address", Type: proto.ColumnType_STRING, Description: "The address of the resource instance, as shown by terraform state list."},
+			{Name: "resource_type", Type: proto.ColumnType_STRING, Description: "The type of the resource."},
+			{Name: "provider", Type: proto.ColumnType_STRING, Description: "The provider configuration that manages the resource, as written on the state file."},
+			{Name: "change", Type: proto.ColumnType_STRING, Description: "update if an attribute changed, delete if the resource no longer exists."},
+			{Name: "path", Type: proto.ColumnType_STRING, Description: "The attribute that changed, such as settings[0].enabled or tags[\"env\"]. Null for deleted resources."},
+			{Name: "old_value", Type: proto.ColumnType_JSON, Description: "The value on the state file, or \"(sensitive value)\" for sensitive attributes."},
+			{Name: "new_value", Type: proto.ColumnType_JSON, Description: "The value on the remote system, or \"(sensitive value)\" for sensitive attributes."},
+			// NullIfZero (from the default transform) would turn false into null
+			{Name: "sensitive", Type: proto.ColumnType_BOOL, Description: "True if the attribute is sensitive, in which case its values are not shown.", Transform: transform.FromField("Sensitive")},
+		},
+	}, nil
+}
+
+func ListDrift(targets []*driftTarget, retries *retryPolicy) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+		config := GetConfig(d.Connection)
+		timeout, err := config.GetReadTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		states, err := loadStateFiles(ctx, config.StateFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		resourceType := d.EqualsQualString("resource_type")
+		address, file := d.EqualsQualString("address"), d.EqualsQualString("state_file")
+		for _, target := range targets {
+			var rows []stateRow
+			for _, row := range stateRows(states, target.provider, resourceType, address, file) {
+				// resource types that the provider doesn't know were already logged when creating the tables
+				if _, ok := target.schemas[row.resource.Type]; ok {
+					rows = append(rows, row)
+				}
+			}
+
+			order, groups, err := groupStateRows(target.instances, rows, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, instance := range order {
+				results, err := readStateRows(ctx, "drift of "+instance.Name, driftTableName, instance, groups[instance], true, retries, timeout)
+				if err != nil {
+					return nil, err
+				}
+				for _, result := range results {
+					drifts, err := driftRows(result, target.schemas[result.resource.Type])
+					if err != nil {
+						return nil, err
+					}
+					plugin.Logger(ctx).Info("tfbridge.ListDrift.compared", "address", result.address(), "changes", len(drifts))
+					for _, row := range drifts {
+						d.StreamListItem(ctx, row)
+					}
+				}
+			}
+		}
+		return nil, nil
+	}
+}
+
+// driftRows compares the value of a resource on the state with its current value
+func driftRows(result stateResult, schema providers.Schema) ([]driftRow, error) {
+	base := driftRow{
+		StateFile:    result.state.location,
+		Address:      result.address(),
+		ResourceType: result.resource.Type,
+		Provider:     result.resource.Provider,
+	}
+	if result.current.IsNull() {
+		base.Change = driftChangeDelete
+		return []driftRow{base}, nil
+	}
+
+	var rows []driftRow
+	for _, change := range diffValues(result.prior, result.current, schema.Block) {
+		row := base
+		row.Change, row.Path, row.Sensitive = driftChangeUpdate, change.path, change.sensitive
+		var err error
+		if row.OldValue, err = change.oldJSON(); err != nil {
+			return nil, err
+		}
+		if row.NewValue, err = change.newJSON(); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
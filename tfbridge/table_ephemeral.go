@@ -0,0 +1,175 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ephemeralCloseTimeout bounds the call that closes an ephemeral resource, which runs even if the query was
+// cancelled, so that leases and temporary credentials are revoked as soon as possible
+const ephemeralCloseTimeout = 30 * time.Second
+
+// tableTFBridgeEphemeral creates a table for an ephemeral resource type, such as a Vault secret or temporary cloud
+// credentials. Its columns and key columns are built like those of a data source
+// Every query opens the resource with the quals as its configuration (OpenEphemeralResource), streams the result
+// as a single row, and closes it right away (CloseEphemeralResource). If the provider asks for the resource to be
+// renewed while it's open, it's renewed too
+// The values are short-lived and usually secret, so the table is never cached and its rows are never logged
+func tableTFBridgeEphemeral(ctx context.Context, connection *plugin.Connection, instances []*providerInstance, tablePrefix string) (*plugin.Table, error) {
+	name := ctx.Value(keyEphemeralResource).(string)
+	schema := ctx.Value(keySchema).(providers.Schema)
+
+	config := GetConfig(connection)
+	retries, err := newRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	flattenDepth, err := config.GetFlattenDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	index := tableIndexes.get(tableIndexKey{instances[0].schemaKey, tableKindEphemeral, name, flattenDepth}, func() *tableIndex {
+		return newTableIndex(ctx, schema.Block, flattenDepth)
+	})
+	columns, keyColumns := index.newColumns(), index.newKeyColumns()
+	if len(instances) > 1 {
+		columns, keyColumns = appendAliasColumn(columns, keyColumns)
+	}
+
+	return &plugin.Table{
+		Name:        shortenIdentifier(tablePrefix + name),
+		Description: fmt.Sprintf("%s (ephemeral resource): %s", name, schema.Block.Description),
+		List: &plugin.ListConfig{
+			Hydrate:    ListEphemeralResource(name, instances, retries, index),
+			KeyColumns: keyColumns,
+		},
+		Columns: columns,
+		// the cache would keep secrets around (and return them after they were closed), so every query opens the
+		// resource again
+		Cache: &plugin.TableCacheOptions{Enabled: false},
+	}, nil
+}
+
+func ListEphemeralResource(name string, instances []*providerInstance, retries *retryPolicy, index *tableIndex) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+		config := GetConfig(d.Connection)
+
+		// like in ListDataSource, the quals aren't logged, since they usually hold secrets
+		plugin.Logger(ctx).Info("tfbridge.ListEphemeralResource", "type", name)
+		timeout, err := config.GetReadTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		// the row must be streamed while the resource is still open, so this can't go through streamFromInstances,
+		// which streams after read returns. Configurations are opened one at a time instead
+		for _, instance := range targetInstances(d, instances) {
+			err := callProvider(ctx, "ephemeral resource "+name, name, instance, true, retries, timeout, func(ctx context.Context, conn providers.Interface) error {
+				return openEphemeralResource(ctx, conn, name, d.EqualsQuals, index, func(result cty.Value) {
+					row := map[string]cty.Value{}
+					for k, v := range result.AsValueMap() {
+						row[k] = v
+					}
+					if len(instances) > 1 {
+						row[aliasColumnName] = cty.StringVal(instance.GetAlias())
+					}
+					d.StreamListItem(ctx, row)
+				})
+			})
+			if err != nil {
+				return nil, err
+			}
+			plugin.Logger(ctx).Info("tfbridge.ListEphemeralResource.closed", "type", name, "alias", instance.GetAlias())
+		}
+		return nil, nil
+	}
+}
+
+// openEphemeralResource opens an ephemeral resource, using the quals as its config, calls use with its value, and
+// then closes it. The resource is kept alive (renewed) for as long as use runs
+// Errors while closing are only logged: the value was already used, and retrying would open the resource again
+func openEphemeralResource(ctx context.Context, provider providers.Interface, typeName string, quals map[string]*proto.QualValue, index *tableIndex, use func(result cty.Value)) error {
+	schemas, err := getEphemeralResourceTypes(ctx, provider)
+	if err != nil {
+		return err
+	}
+	schema, ok := schemas[typeName]
+	if !ok {
+		return fmt.Errorf("ephemeral resource %s not found", typeName)
+	}
+	config, err := qualsToConfig(ctx, quals, index.getFields(schema.Block), schema.Block.ImpliedType())
+	if err != nil {
+		return err
+	}
+
+	stop := stopOnCancel(ctx, provider)
+	opened := provider.OpenEphemeralResource(ctx, providers.OpenEphemeralResourceRequest{
+		TypeName: typeName,
+		Config:   config,
+	})
+	stop()
+	if opened.Diagnostics.HasErrors() {
+		return opened.Diagnostics.Err()
+	}
+
+	stopRenewing := renewEphemeralResource(ctx, provider, typeName, opened.RenewAt, opened.Private)
+	defer func() {
+		stopRenewing()
+		// the query may have been cancelled already, but the resource must be closed anyway
+		closeCtx, cancel := context.WithTimeout(context.Background(), ephemeralCloseTimeout)
+		defer cancel()
+		closed := provider.CloseEphemeralResource(closeCtx, providers.CloseEphemeralResourceRequest{
+			TypeName: typeName,
+			Private:  opened.Private,
+		})
+		if closed.Diagnostics.HasErrors() {
+			plugin.Logger(ctx).Warn("tfbridge.openEphemeralResource.close", "type", typeName, "err", closed.Diagnostics.Err())
+		}
+	}()
+
+	use(opened.Result)
+	return nil
+}
+
+// renewEphemeralResource renews an open ephemeral resource every time that the provider asks for it (renewAt), until
+// the returned func is called. A zero renewAt means that the resource doesn't need renewing
+// Renewals use their own private data, which the provider may change on each one, while closing always uses the one
+// returned when opening, like Terraform does
+func renewEphemeralResource(ctx context.Context, provider providers.Interface, typeName string, renewAt time.Time, private []byte) func() {
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		for !renewAt.IsZero() {
+			timer := time.NewTimer(time.Until(renewAt))
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				return
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+
+			plugin.Logger(ctx).Info("tfbridge.renewEphemeralResource", "type", typeName, "renew_at", renewAt)
+			resp := provider.RenewEphemeralResource(ctx, providers.RenewEphemeralResourceRequest{TypeName: typeName, Private: private})
+			if resp.Diagnostics.HasErrors() {
+				// the value may still be valid for a while, so let the query finish
+				plugin.Logger(ctx).Warn("tfbridge.renewEphemeralResource", "type", typeName, "err", resp.Diagnostics.Err())
+				return
+			}
+			renewAt, private = resp.RenewAt, resp.Private
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
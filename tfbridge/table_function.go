@@ -0,0 +1,178 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// functionResultColumnName holds the return value of the function
+const functionResultColumnName = "result"
+
+// functionResultKey is where the result is stored on rows, parameter names can't contain a colon so it never clashes
+const functionResultKey = "tfbridge:result"
+
+// tableTFBridgeFunction creates a table for a provider-defined function (what Terraform calls as
+// provider::<provider>::<function>(...))
+// Each parameter becomes a required key column, and the function is called with the quals as arguments, returning
+// a single row with the return value on the result column. A variadic parameter becomes an optional JSONB column
+// that holds an array with the extra arguments
+// Functions are pure and run on an unconfigured provider, so all configurations (aliases) of the provider share them
+func tableTFBridgeFunction(ctx context.Context, connection *plugin.Connection, instance *providerInstance, name string, decl providers.FunctionDecl, tablePrefix string) (*plugin.Table, error) {
+	retries, err := newRetryPolicy(GetConfig(connection))
+	if err != nil {
+		return nil, err
+	}
+
+	index := tableIndexes.get(tableIndexKey{instance.schemaKey, tableKindFunction, name, 0}, func() *tableIndex {
+		return newFunctionIndex(ctx, decl)
+	})
+	resultType := attrTypeToColumnType(ctx, decl.ReturnType, cty.NilType)
+	columns := append(index.newColumns(), &plugin.Column{
+		Name:        functionResultColumnName,
+		Type:        resultType,
+		Description: "The value returned by the function.",
+		Transform:   FromCtyMapKey(functionResultKey),
+	})
+
+	description := decl.Summary
+	if description == "" {
+		description = decl.Description
+	}
+	if decl.DeprecationMessage != "" {
+		description += " Deprecated: " + decl.DeprecationMessage
+	}
+
+	return &plugin.Table{
+		Name:        shortenIdentifier(tablePrefix + name),
+		Description: fmt.Sprintf("provider::%s::%s (function): %s", instance.Name, name, description),
+		List: &plugin.ListConfig{
+			Hydrate:    ListFunction(name, instance, decl, index, retries),
+			KeyColumns: index.newKeyColumns(),
+		},
+		Columns: columns,
+	}, nil
+}
+
+// newFunctionIndex builds the tableIndex of a function, whose fields are its parameters. They're few, and don't come
+// from a schema that reads get anyway, so they're kept from the start
+func newFunctionIndex(ctx context.Context, decl providers.FunctionDecl) *tableIndex {
+	fields := functionFields(decl)
+	makeColumnNames(fields, functionResultColumnName)
+	index := &tableIndex{columns: makeColumnSpecs(ctx, fields), keyColumns: makeKeyColumnSpecs(ctx, fields)}
+	index.fieldsOnce.Do(func() { index.fields = fields })
+	return index
+}
+
+// functionFields returns a field for each parameter of a function, which are all required, except for the variadic
+// one. Arguments are positional, so their order is kept (the variadic parameter goes last)
+func functionFields(decl providers.FunctionDecl) []tableField {
+	params := decl.Parameters
+	if decl.VariadicParameter != nil {
+		params = append(params[:len(params):len(params)], *decl.VariadicParameter)
+	}
+
+	fields := make([]tableField, 0, len(params))
+	for i, p := range params {
+		// names are only for documentation, and may be missing
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("arg%d", i)
+		}
+		attr := &configschema.Attribute{Type: p.Type, Description: p.Description, Required: true}
+		if i == len(decl.Parameters) {
+			attr.Type, attr.Required, attr.Optional = cty.List(p.Type), false, true
+		}
+		fields = append(fields, tableField{path: []string{name}, attribute: attr})
+	}
+	return fields
+}
+
+func ListFunction(name string, instance *providerInstance, decl providers.FunctionDecl, index *tableIndex, retries *retryPolicy) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+		config := GetConfig(d.Connection)
+		timeout, err := config.GetReadTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		// the row echoes the arguments, so that the key columns match the quals
+		fields := index.getFields(nil)
+		row := map[string]cty.Value{}
+		var args []cty.Value
+		for i, f := range fields {
+			qual, ok := d.EqualsQuals[f.column]
+			variadic := i == len(decl.Parameters)
+			if !ok {
+				if !variadic {
+					// the SDK ensures that required key columns are always set
+					return nil, fmt.Errorf("missing argument %s", f.column)
+				}
+				row[f.path[0]] = cty.NullVal(f.attribute.Type)
+				continue
+			}
+			val, err := qualToCtyValue(qual, f.attribute.Type)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument %s: %w", f.column, err)
+			}
+			row[f.path[0]] = val
+			if !variadic {
+				args = append(args, val)
+				continue
+			}
+			for it := val.ElementIterator(); it.Next(); {
+				_, v := it.Element()
+				args = append(args, v)
+			}
+		}
+
+		err = callProvider(ctx, "function "+name, name, instance, false, retries, timeout, func(ctx context.Context, conn providers.Interface) error {
+			resp := conn.CallFunction(ctx, providers.CallFunctionRequest{FunctionName: name, Arguments: args})
+			if resp.Err != nil {
+				return resp.Err
+			}
+			row[functionResultKey] = resp.Result
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// arguments and results may be secrets (e.g. functions that decode or sign something), so they aren't logged
+		plugin.Logger(ctx).Info("tfbridge.ListFunction.result", "function", name)
+		d.StreamListItem(ctx, row)
+		return nil, nil
+	}
+}
+
+// qualToCtyValue converts the value of a qual into a value of the given type
+// Columns of complex types are JSONB, so their quals are decoded as JSON. Types that include "any"
+// (cty.DynamicPseudoType) are replaced by the type implied by the JSON, e.g. objects for JSON objects and tuples for
+// arrays
+func qualToCtyValue(qual *proto.QualValue, ty cty.Type) (cty.Value, error) {
+	switch ty {
+	case cty.String:
+		return cty.StringVal(qual.GetStringValue()), nil
+	case cty.Number:
+		return cty.NumberFloatVal(qual.GetDoubleValue()), nil
+	case cty.Bool:
+		return cty.BoolVal(qual.GetBoolValue()), nil
+	}
+
+	raw := []byte(qual.GetJsonbValue())
+	// the provider converts arguments of types such as list(any) itself, so the implied type is enough
+	if ty.HasDynamicTypes() {
+		implied, err := ctyjson.ImpliedType(raw)
+		if err != nil {
+			return cty.NilVal, err
+		}
+		ty = implied
+	}
+	return ctyjson.Unmarshal(raw, ty)
+}
@@ -0,0 +1,140 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// importIDColumnName is the key column of resource tables, it holds the ID that's passed to the provider's importer
+// It's not always the same as the resource's id attribute (e.g. github_branch_protection is imported with
+// "repository:pattern"), see the Import section of the provider's docs
+const importIDColumnName = "import_id"
+
+// tableTFBridgeResource creates a read-only table for a managed resource type
+// Rows are read exactly like `terraform import` followed by a refresh: the provider imports the resource identified
+// by the import_id qual (ImportResourceState) and then reads its current state (ReadResource). Plan and Apply are
+// never called, so nothing is ever changed on the remote system
+func tableTFBridgeResource(ctx context.Context, connection *plugin.Connection, instances []*providerInstance, tablePrefix string) (*plugin.Table, error) {
+	name := ctx.Value(keyResourceType).(string)
+	schema := ctx.Value(keySchema).(providers.Schema)
+
+	config := GetConfig(connection)
+	retries, err := newRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	flattenDepth, err := config.GetFlattenDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	index := tableIndexes.get(tableIndexKey{instances[0].schemaKey, tableKindResource, name, flattenDepth}, func() *tableIndex {
+		return newTableIndex(ctx, schema.Block, flattenDepth, importIDColumnName)
+	})
+	// all attributes are read-only here (so the key columns of the index are ignored), the resource is only
+	// identified by its import ID
+	columns := append([]*plugin.Column{{
+		Name:        importIDColumnName,
+		Type:        proto.ColumnType_STRING,
+		Description: "The ID that the resource was imported with, in the format described in the Import section of the provider docs.",
+		Transform:   FromCtyMapKey(importIDColumnName),
+	}}, index.newColumns()...)
+	keyColumns := plugin.KeyColumnSlice{{
+		Name:      importIDColumnName,
+		Operators: []string{"="},
+		Require:   plugin.Required,
+	}}
+	if len(instances) > 1 {
+		columns, keyColumns = appendAliasColumn(columns, keyColumns)
+	}
+
+	return &plugin.Table{
+		Name:        shortenIdentifier(tablePrefix + name),
+		Description: fmt.Sprintf("%s (resource): %s", name, schema.Block.Description),
+		List: &plugin.ListConfig{
+			Hydrate:    ListResource(name, instances, retries),
+			KeyColumns: keyColumns,
+		},
+		Columns: columns,
+	}, nil
+}
+
+func ListResource(name string, instances []*providerInstance, retries *retryPolicy) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+		config := GetConfig(d.Connection)
+
+		// like the rows, import IDs are never logged, since they may be sensitive
+		plugin.Logger(ctx).Info("tfbridge.ListResource", "type", name)
+		timeout, err := config.GetReadTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		// the SDK expands "import_id in (...)" into one call per value, so there's always a single ID here
+		importID := d.EqualsQualString(importIDColumnName)
+		if importID == "" {
+			return nil, nil
+		}
+
+		return nil, streamFromInstances(ctx, d, instances, func(ctx context.Context, instance *providerInstance) ([]map[string]cty.Value, error) {
+			var rows []map[string]cty.Value
+			err := callProvider(ctx, "resource "+name, name, instance, true, retries, timeout, func(ctx context.Context, conn providers.Interface) error {
+				var err error
+				rows, err = importResource(ctx, conn, name, importID)
+				return err
+			})
+			return rows, err
+		})
+	}
+}
+
+// importResource imports a resource by ID and refreshes it, returning its current state
+// Resources that don't exist (anymore) return no rows, like a data source that finds nothing
+func importResource(ctx context.Context, provider providers.Interface, typeName, importID string) ([]map[string]cty.Value, error) {
+	stop := stopOnCancel(ctx, provider)
+	defer stop()
+
+	imported := provider.ImportResourceState(ctx, providers.ImportResourceStateRequest{
+		TypeName: typeName,
+		ID:       importID,
+	})
+	if imported.Diagnostics.HasErrors() {
+		return nil, imported.Diagnostics.Err()
+	}
+
+	var rows []map[string]cty.Value
+	for _, resource := range imported.ImportedResources {
+		// some importers also return related resources of other types, those don't belong to this table
+		if resource.TypeName != typeName {
+			continue
+		}
+
+		read := provider.ReadResource(ctx, providers.ReadResourceRequest{
+			TypeName:     typeName,
+			PriorState:   resource.State,
+			Private:      resource.Private,
+			ProviderMeta: cty.EmptyObjectVal,
+		})
+		if read.Diagnostics.HasErrors() {
+			return nil, read.Diagnostics.Err()
+		}
+		if read.NewState.IsNull() {
+			plugin.Logger(ctx).Info("tfbridge.importResource.gone", "type", typeName)
+			continue
+		}
+
+		// AsValueMap returns nil for objects without attributes, which can't be added to
+		row := map[string]cty.Value{}
+		for k, v := range read.NewState.AsValueMap() {
+			row[k] = v
+		}
+		row[importIDColumnName] = cty.StringVal(importID)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
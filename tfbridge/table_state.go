@@ -0,0 +1,288 @@
+package tfbridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// columns that state tables add to the resource's own attributes, they start with an underscore like _alias so
+// that they rarely clash with attribute names
+const (
+	stateFileColumnName     = "_state_file"
+	stateAddressColumnName  = "_address"
+	stateModuleColumnName   = "_module"
+	stateIndexKeyColumnName = "_index_key"
+	stateProviderColumnName = "_provider"
+	stateExistsColumnName   = "_exists"
+)
+
+// tableTFBridgeState creates a table for a managed resource type, whose rows are the instances of that type found on
+// the state files of the connection
+// Values are upgraded to the provider's current schema version (UpgradeResourceState) like Terraform does when it
+// reads an older state. With state_refresh, they are also read again from the remote system (ReadResource), and
+// the _exists column tells whether the resource still exists
+func tableTFBridgeState(ctx context.Context, connection *plugin.Connection, instances []*providerInstance, provider tfaddr.Provider, tablePrefix string) (*plugin.Table, error) {
+	name := ctx.Value(keyResourceType).(string)
+	schema := ctx.Value(keySchema).(providers.Schema)
+
+	config := GetConfig(connection)
+	retries, err := newRetryPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	flattenDepth, err := config.GetFlattenDepth()
+	if err != nil {
+		return nil, err
+	}
+	refresh := config.GetStateRefresh()
+
+	index := tableIndexes.get(tableIndexKey{instances[0].schemaKey, tableKindState, name, flattenDepth}, func() *tableIndex {
+		return newTableIndex(ctx, schema.Block, flattenDepth, stateFileColumnName, stateAddressColumnName, stateModuleColumnName, stateIndexKeyColumnName, stateProviderColumnName, stateExistsColumnName)
+	})
+	columns := []*plugin.Column{
+		{Name: stateAddressColumnName, Type: proto.ColumnType_STRING, Description: "The address of the resource instance, as shown by terraform state list.", Transform: FromCtyMapKey(stateAddressColumnName)},
+		{Name: stateFileColumnName, Type: proto.ColumnType_STRING, Description: "The state file (path or URL) that holds the resource.", Transform: FromCtyMapKey(stateFileColumnName)},
+		{Name: stateModuleColumnName, Type: proto.ColumnType_STRING, Description: "The module that holds the resource, empty for the root module.", Transform: FromCtyMapKey(stateModuleColumnName)},
+		{Name: stateIndexKeyColumnName, Type: proto.ColumnType_STRING, Description: "The index of the instance as it appears on its address (e.g. 0 or \"foo\"), for resources with count or for_each.", Transform: FromCtyMapKey(stateIndexKeyColumnName)},
+		{Name: stateProviderColumnName, Type: proto.ColumnType_STRING, Description: "The provider configuration that manages the resource.", Transform: FromCtyMapKey(stateProviderColumnName)},
+	}
+	if refresh {
+		columns = append(columns, &plugin.Column{
+			Name:        stateExistsColumnName,
+			Type:        proto.ColumnType_BOOL,
+			Description: "False if the resource no longer exists on the remote system, in which case the other columns hold the values on the state.",
+			Transform:   FromCtyMapKey(stateExistsColumnName),
+		})
+	}
+	columns = append(columns, index.newColumns()...)
+	// these are filtered before any call to the provider, which is the slow part
+	keyColumns := plugin.KeyColumnSlice{
+		{Name: stateAddressColumnName, Operators: []string{"="}, Require: plugin.Optional},
+		{Name: stateFileColumnName, Operators: []string{"="}, Require: plugin.Optional},
+	}
+
+	return &plugin.Table{
+		Name:        shortenIdentifier(tablePrefix + name),
+		Description: fmt.Sprintf("%s (state): %s", name, schema.Block.Description),
+		List: &plugin.ListConfig{
+			Hydrate:    ListState(name, instances, provider, refresh, retries),
+			KeyColumns: keyColumns,
+		},
+		Columns: columns,
+	}, nil
+}
+
+// stateRow is a resource instance read from a state file, before it's sent to the provider
+type stateRow struct {
+	state    *stateFile
+	resource stateResource
+	instance stateInstance
+	alias    string
+}
+
+func ListState(name string, instances []*providerInstance, provider tfaddr.Provider, refresh bool, retries *retryPolicy) func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	return func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+		config := GetConfig(d.Connection)
+		timeout, err := config.GetReadTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		// the files are read again on every query, since they change every time Terraform applies something
+		states, err := loadStateFiles(ctx, config.StateFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := stateRows(states, provider, name, d.EqualsQualString(stateAddressColumnName), d.EqualsQualString(stateFileColumnName))
+		order, groups, err := groupStateRows(instances, rows, refresh)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range order {
+			results, err := readStateRows(ctx, "state of "+name, name, instance, groups[instance], refresh, retries, timeout)
+			if err != nil {
+				return nil, err
+			}
+			for _, result := range results {
+				d.StreamListItem(ctx, result.toRow(refresh))
+			}
+		}
+		return nil, nil
+	}
+}
+
+// stateRows returns the instances of a resource type (or of all types, if name is empty) on the state files
+// address and file, if set, skip all other instances, so that they never reach the provider
+// Deposed instances (those that are about to be destroyed after a create_before_destroy replacement) are skipped
+func stateRows(states []*stateFile, provider tfaddr.Provider, name, address, file string) []stateRow {
+	var rows []stateRow
+	for _, state := range states {
+		if file != "" && state.location != file {
+			continue
+		}
+		for _, resource := range state.managedResources(provider) {
+			if name != "" && resource.Type != name {
+				continue
+			}
+			// managedResources already checked that the provider parses
+			_, alias, _ := parseStateProvider(resource.Provider)
+			for _, instance := range resource.Instances {
+				if instance.Deposed != "" || (address != "" && resource.address(instance) != address) {
+					continue
+				}
+				rows = append(rows, stateRow{state: state, resource: resource, instance: instance, alias: alias})
+			}
+		}
+	}
+	return rows
+}
+
+// groupStateRows picks the configuration that reads each row, and returns them in the order they first appear
+// Without refresh, any configuration can upgrade the values, so they all go to the default one. With refresh, each
+// resource must be read with the same configuration (credentials) that Terraform used
+func groupStateRows(instances []*providerInstance, rows []stateRow, refresh bool) ([]*providerInstance, map[*providerInstance][]stateRow, error) {
+	groups := map[*providerInstance][]stateRow{}
+	var order []*providerInstance
+	for _, row := range rows {
+		instance := defaultInstance(instances)
+		if refresh {
+			instance = instanceForAlias(instances, row.alias)
+			if instance == nil {
+				return nil, nil, fmt.Errorf("%s on %s uses provider configuration %q, but no provider block has that alias", row.address(), row.state.location, row.alias)
+			}
+		}
+		if _, ok := groups[instance]; !ok {
+			order = append(order, instance)
+		}
+		groups[instance] = append(groups[instance], row)
+	}
+	return order, groups, nil
+}
+
+func (r stateRow) address() string {
+	return r.resource.address(r.instance)
+}
+
+// defaultInstance returns the configuration without an alias, like Terraform uses for resources that don't set
+// the provider meta-argument, or the first one if all have aliases
+func defaultInstance(instances []*providerInstance) *providerInstance {
+	if instance := instanceForAlias(instances, ""); instance != nil {
+		return instance
+	}
+	return instances[0]
+}
+
+// instanceForAlias returns the configuration with the given alias (empty for the default one), or nil if none matches
+func instanceForAlias(instances []*providerInstance, alias string) *providerInstance {
+	for _, i := range instances {
+		if (alias == "" && i.Alias == nil) || (i.Alias != nil && *i.Alias == alias) {
+			return i
+		}
+	}
+	return nil
+}
+
+// stateResult is a resource instance from a state file after going through the provider
+type stateResult struct {
+	stateRow
+	// prior is the value on the state, upgraded to the current schema version
+	prior cty.Value
+	// current is the value on the remote system, which is null if the resource is gone, and the same as prior
+	// without refresh
+	current cty.Value
+}
+
+// readStateRows upgrades (and, with refresh, reads again) a batch of resource instances with a single provider
+// process, since starting one per instance would be much slower
+// what and name are passed to callProvider, for errors and rate limits
+func readStateRows(ctx context.Context, what, name string, instance *providerInstance, rows []stateRow, refresh bool, retries *retryPolicy, timeout time.Duration) ([]stateResult, error) {
+	var results []stateResult
+	err := callProvider(ctx, what, name, instance, refresh, retries, timeout, func(ctx context.Context, conn providers.Interface) error {
+		stop := stopOnCancel(ctx, conn)
+		defer stop()
+
+		// a retry starts from scratch, so rows from a failed attempt must not be kept
+		results = make([]stateResult, 0, len(rows))
+		for _, row := range rows {
+			result, err := readStateRow(ctx, conn, row, refresh)
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func readStateRow(ctx context.Context, provider providers.Interface, row stateRow, refresh bool) (stateResult, error) {
+	name := row.resource.Type
+
+	// Terraform always calls this, even if the versions match, since providers also use it to normalize values
+	upgraded := provider.UpgradeResourceState(ctx, providers.UpgradeResourceStateRequest{
+		TypeName:        name,
+		Version:         row.instance.SchemaVersion,
+		RawStateJSON:    row.instance.Attributes,
+		RawStateFlatmap: row.instance.AttributesFlat,
+	})
+	if upgraded.Diagnostics.HasErrors() {
+		return stateResult{}, fmt.Errorf("upgrading %s on %s: %w", row.address(), row.state.location, upgraded.Diagnostics.Err())
+	}
+	result := stateResult{stateRow: row, prior: upgraded.UpgradedState, current: upgraded.UpgradedState}
+	if !refresh {
+		return result, nil
+	}
+
+	read := provider.ReadResource(ctx, providers.ReadResourceRequest{
+		TypeName:     name,
+		PriorState:   result.prior,
+		Private:      row.instance.Private,
+		ProviderMeta: cty.EmptyObjectVal,
+	})
+	if read.Diagnostics.HasErrors() {
+		return stateResult{}, fmt.Errorf("refreshing %s on %s: %w", row.address(), row.state.location, read.Diagnostics.Err())
+	}
+	if read.NewState.IsNull() {
+		plugin.Logger(ctx).Info("tfbridge.readStateRow.gone", "address", row.address(), "state", row.state.location)
+	}
+	result.current = read.NewState
+	return result, nil
+}
+
+// toRow returns the row of a state table, which shows the current values, or the ones on the state if the
+// resource is gone
+func (r stateResult) toRow(refresh bool) map[string]cty.Value {
+	exists := !r.current.IsNull()
+	state := r.current
+	if !exists {
+		state = r.prior
+	}
+
+	// AsValueMap returns nil for objects without attributes, which can't be added to
+	row := map[string]cty.Value{}
+	if !state.IsNull() {
+		for k, v := range state.AsValueMap() {
+			row[k] = v
+		}
+	}
+	row[stateAddressColumnName] = cty.StringVal(r.address())
+	row[stateFileColumnName] = cty.StringVal(r.state.location)
+	row[stateModuleColumnName] = cty.StringVal(r.resource.Module)
+	row[stateIndexKeyColumnName] = cty.NullVal(cty.String)
+	if key := formatIndexKey(r.instance.IndexKey); key != "" {
+		row[stateIndexKeyColumnName] = cty.StringVal(key)
+	}
+	row[stateProviderColumnName] = cty.StringVal(r.resource.Provider)
+	if refresh {
+		row[stateExistsColumnName] = cty.BoolVal(exists)
+	}
+	return row
+}
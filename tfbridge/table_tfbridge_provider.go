@@ -0,0 +1,219 @@
+package tfbridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// providerInfoTableName is the name of the table that lists the provider processes of the connection
+const providerInfoTableName = "tfbridge_provider"
+
+// providerInfo describes a provider process, see tableTFBridgeProvider
+// The field names match the column names, so the default transform (FromGo) picks them up
+type providerInfo struct {
+	Process              string
+	Status               string
+	Provider             string
+	Aliases              []string
+	Source               string
+	Version              string
+	Configured           bool
+	Reattached           bool
+	BinaryPath           string
+	BinarySha256         *string
+	Pid                  *int
+	ProtocolVersion      *int
+	ServerCapabilities   *serverCapabilitiesInfo
+	ConfigureDiagnostics []diagnosticInfo
+	Error                *string
+	StartedAt            time.Time
+	UptimeSeconds        *float64
+	LastUsedAt           *time.Time
+	Requests             int
+	ActiveRequests       int
+}
+
+type serverCapabilitiesInfo struct {
+	PlanDestroy               bool `json:"plan_destroy"`
+	GetProviderSchemaOptional bool `json:"get_provider_schema_optional"`
+}
+
+type diagnosticInfo struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+func newDiagnosticInfos(diags tfdiags.Diagnostics) []diagnosticInfo {
+	var res []diagnosticInfo
+	for _, d := range diags {
+		severity := "warning"
+		if d.Severity() == tfdiags.Error {
+			severity = "error"
+		}
+		desc := d.Description()
+		res = append(res, diagnosticInfo{Severity: severity, Summary: desc.Summary, Detail: desc.Detail})
+	}
+	return res
+}
+
+// binaryChecksums caches the checksums of the provider binaries, which may be hundreds of MB, by path
+// Downloaded binaries never change, so they're only hashed the first time that the table is queried
+var binaryChecksums = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+func binaryChecksum(path string) (string, error) {
+	binaryChecksums.Lock()
+	defer binaryChecksums.Unlock()
+	if sum, ok := binaryChecksums.m[path]; ok {
+		return sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	binaryChecksums.m[path] = sum
+	return sum, nil
+}
+
+// newProviderInfo describes a process of providerProcesses. instances are the configurations of the connection
+// that can use it: all configurations of the provider for unconfigured processes, or those with the same
+// configuration otherwise
+func newProviderInfo(ctx context.Context, st processStatus, instances []*providerInstance) providerInfo {
+	provider := instances[0]
+	info := providerInfo{
+		Process:              strings.TrimSuffix(st.logPrefix, "."),
+		Status:               st.status,
+		Provider:             provider.Name,
+		Source:               provider.Source,
+		Version:              provider.Version,
+		Configured:           st.key.configHash != "",
+		Reattached:           provider.reattach != nil,
+		BinaryPath:           provider.pluginLocation,
+		ConfigureDiagnostics: newDiagnosticInfos(st.configureDiags),
+		StartedAt:            st.startedAt,
+		Requests:             st.requests,
+		ActiveRequests:       st.activeRequests,
+	}
+	if info.Configured {
+		for _, i := range instances {
+			if i.Alias != nil {
+				info.Aliases = append(info.Aliases, *i.Alias)
+			}
+		}
+	}
+	// reattached providers have no binary that the plugin knows about
+	if provider.pluginLocation != "" {
+		if sum, err := binaryChecksum(provider.pluginLocation); err == nil {
+			info.BinarySha256 = &sum
+		} else {
+			plugin.Logger(ctx).Warn("tfbridge.newProviderInfo.binaryChecksum", "path", provider.pluginLocation, "err", err)
+		}
+	}
+	if st.err != nil {
+		msg := st.err.Error()
+		info.Error = &msg
+	}
+	if !st.lastUsed.IsZero() {
+		info.LastUsedAt = &st.lastUsed
+	}
+	if st.status == processFailed {
+		return info
+	}
+	uptime := time.Since(st.startedAt).Seconds()
+	info.UptimeSeconds = &uptime
+
+	if st.conn == nil {
+		return info
+	}
+	if client, protocol := pluginClient(st.conn); client != nil {
+		if reattach := client.ReattachConfig(); reattach != nil {
+			info.Pid = &reattach.Pid
+		}
+		info.ProtocolVersion = &protocol
+	}
+	if st.status != processCrashed {
+		// this comes from the schema cache, so it usually doesn't reach the provider
+		metadata := st.conn.GetMetadata(ctx)
+		if !metadata.Diagnostics.HasErrors() {
+			info.ServerCapabilities = &serverCapabilitiesInfo{
+				PlanDestroy:               metadata.ServerCapabilities.PlanDestroy,
+				GetProviderSchemaOptional: metadata.ServerCapabilities.GetProviderSchemaOptional,
+			}
+		}
+	}
+	return info
+}
+
+// tableTFBridgeProvider lists the provider processes that the connection is using, for debugging. Processes are
+// shared between connections (see providerProcesses), so it includes those started by other connections that have
+// the same provider, version and configuration
+// Like tfbridge_table, every connection has it, and it's never cached, since processes come and go all the time
+func tableTFBridgeProvider(instances []*providerInstance) *plugin.Table {
+	return &plugin.Table{
+		Name:        providerInfoTableName,
+		Description: "Terraform provider processes that this connection is using, and the last failed attempt to start each one.",
+		List: &plugin.ListConfig{
+			Hydrate: func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+				statuses := providerProcesses.status()
+				sort.Slice(statuses, func(i, j int) bool { return statuses[i].startedAt.Before(statuses[j].startedAt) })
+				for _, st := range statuses {
+					var matching []*providerInstance
+					for _, i := range instances {
+						if i.schemaKey == st.key.schemaKey && i.processHash == st.key.processHash && (st.key.configHash == "" || i.configHash == st.key.configHash) {
+							matching = append(matching, i)
+						}
+					}
+					if len(matching) == 0 {
+						continue
+					}
+					d.StreamListItem(ctx, newProviderInfo(ctx, st, matching))
+				}
+				return nil, nil
+			},
+		},
+		Columns: []*plugin.Column{
+			{Name: "process", Type: proto.ColumnType_STRING, Description: "Name of the process in the plugin log, empty for failed attempts to start one."},
+			{Name: "status", Type: proto.ColumnType_STRING, Description: "One of starting, idle, busy, stopping (no longer used for new reads), crashed, or failed (the last attempt to start or configure a process failed)."},
+			{Name: "provider", Type: proto.ColumnType_STRING, Description: "Name of the provider block."},
+			{Name: "aliases", Type: proto.ColumnType_JSON, Description: "Aliases of the provider configurations that use the process, if the provider is configured more than once."},
+			{Name: "source", Type: proto.ColumnType_STRING, Description: "Source address of the Terraform provider."},
+			{Name: "version", Type: proto.ColumnType_STRING, Description: "Version of the Terraform provider."},
+			{Name: "configured", Type: proto.ColumnType_BOOL, Description: "True if the process was configured with provider_config. Unconfigured processes read schemas and upgrade resource states."},
+			{Name: "reattached", Type: proto.ColumnType_BOOL, Description: "True if the provider was already running, and the plugin connected to it through reattach_providers or TF_REATTACH_PROVIDERS."},
+			{Name: "binary_path", Type: proto.ColumnType_STRING, Description: "Path of the provider binary, empty for reattached providers."},
+			{Name: "binary_sha256", Type: proto.ColumnType_STRING, Description: "SHA-256 checksum of the provider binary, in hex."},
+			{Name: "pid", Type: proto.ColumnType_INT, Description: "Process ID."},
+			{Name: "protocol_version", Type: proto.ColumnType_INT, Description: "Version of the Terraform plugin protocol (5 or 6) that was negotiated with the provider."},
+			{Name: "server_capabilities", Type: proto.ColumnType_JSON, Description: "Optional protocol features that the provider supports."},
+			{Name: "configure_diagnostics", Type: proto.ColumnType_JSON, Description: "Errors and warnings returned when configuring the process."},
+			{Name: "error", Type: proto.ColumnType_STRING, Description: "Why the last attempt to start or configure a process failed, for failed rows."},
+			{Name: "started_at", Type: proto.ColumnType_TIMESTAMP, Description: "When the process was started, or when the attempt to start it failed."},
+			{Name: "uptime_seconds", Type: proto.ColumnType_DOUBLE, Description: "Seconds since the process was started."},
+			{Name: "last_used_at", Type: proto.ColumnType_TIMESTAMP, Description: "When the process last finished a read."},
+			{Name: "requests", Type: proto.ColumnType_INT, Description: "Number of reads that the process got, including those in progress."},
+			{Name: "active_requests", Type: proto.ColumnType_INT, Description: "Number of reads in progress."},
+		},
+		Cache: &plugin.TableCacheOptions{Enabled: false},
+	}
+}
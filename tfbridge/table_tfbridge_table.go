@@ -0,0 +1,100 @@
+package tfbridge
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// tableInfoTableName is the name of the table that lists the other tables of the connection
+const tableInfoTableName = "tfbridge_table"
+
+// tableInfo describes one of the tables that were created from a data source, see tableTFBridgeTable
+// The field names match the column names, so the default transform (FromGo) picks them up
+type tableInfo struct {
+	Name         string
+	Kind         string
+	DataSource   string
+	ResourceType string
+	Function     string
+	Provider     string
+	Source       string
+	Version      string
+	Aliases      []string
+	KeyColumns   []keyColumnInfo
+	Columns      []columnInfo
+}
+
+type keyColumnInfo struct {
+	Name      string   `json:"name"`
+	Require   string   `json:"require"`
+	Operators []string `json:"operators"`
+}
+
+type columnInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func newTableInfo(t providerTable) tableInfo {
+	provider := t.instances[0].ProviderBlock
+	info := tableInfo{
+		Name:         t.table.Name,
+		Kind:         t.kind,
+		DataSource:   t.dataSource,
+		ResourceType: t.resourceType,
+		Function:     t.function,
+		Provider:     provider.Name,
+		Source:       provider.Source,
+		Version:      provider.Version,
+	}
+	for _, i := range t.instances {
+		if i.Alias != nil {
+			info.Aliases = append(info.Aliases, *i.Alias)
+		}
+	}
+	for _, k := range t.table.List.KeyColumns {
+		info.KeyColumns = append(info.KeyColumns, keyColumnInfo{Name: k.Name, Require: k.Require, Operators: k.Operators})
+	}
+	for _, c := range t.table.Columns {
+		info.Columns = append(info.Columns, columnInfo{Name: c.Name, Type: strings.ToLower(c.Type.String())})
+	}
+	sort.Slice(info.Columns, func(i, j int) bool { return info.Columns[i].Name < info.Columns[j].Name })
+	return info
+}
+
+// tableTFBridgeTable lists the tables that the connection created from data sources and resource types
+// It's mostly useful on aggregator connections: Steampipe merges the schemas of the member connections, but skips
+// the members that don't have a table, and drops tables whose key columns differ between members. Since this table
+// is the same on every connection, it's always available on the aggregator, and shows what each member provides
+// The rows are only built when the table is queried, since most connections never do
+func tableTFBridgeTable(created []providerTable) *plugin.Table {
+	return &plugin.Table{
+		Name:        tableInfoTableName,
+		Description: "Tables created by this connection from the data sources (and resource types) of its Terraform providers.",
+		List: &plugin.ListConfig{
+			Hydrate: func(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+				for _, t := range created {
+					d.StreamListItem(ctx, newTableInfo(t))
+				}
+				return nil, nil
+			},
+		},
+		Columns: []*plugin.Column{
+			{Name: "name", Type: proto.ColumnType_STRING, Description: "Name of the table."},
+			{Name: "kind", Type: proto.ColumnType_STRING, Description: "What the table reads: data_source, resource (by import ID), state (resources on the state files), function or ephemeral_resource."},
+			{Name: "data_source", Type: proto.ColumnType_STRING, Description: "Name of the Terraform data source that the table reads."},
+			{Name: "resource_type", Type: proto.ColumnType_STRING, Description: "Name of the Terraform resource type that the table reads, for resource, state and ephemeral_resource tables."},
+			{Name: "function", Type: proto.ColumnType_STRING, Description: "Name of the provider-defined function that the table calls, for function tables."},
+			{Name: "provider", Type: proto.ColumnType_STRING, Description: "Name of the provider block that the data source comes from."},
+			{Name: "source", Type: proto.ColumnType_STRING, Description: "Source address of the Terraform provider."},
+			{Name: "version", Type: proto.ColumnType_STRING, Description: "Version of the Terraform provider."},
+			{Name: "aliases", Type: proto.ColumnType_JSON, Description: "Aliases of the provider configurations that the table reads, if the provider is configured more than once."},
+			{Name: "key_columns", Type: proto.ColumnType_JSON, Description: "Key columns of the table. Aggregator connections only include a table if it has the same key columns on all members."},
+			{Name: "columns", Type: proto.ColumnType_JSON, Description: "Names and types of the columns of the table."},
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package tfbridge
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	tfplugin "github.com/jreyesr/steampipe-plugin-tfbridge/plugin"
+	tfplugin6 "github.com/jreyesr/steampipe-plugin-tfbridge/plugin6"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// telemetryName is the service of the spans and the name of the meter. It's the name of the plugin, like on the
+// spans of the Steampipe SDK, which exports them only if STEAMPIPE_OTEL_LEVEL is set (see telemetry.Init)
+const telemetryName = "steampipe-plugin-tfbridge"
+
+// Operations of the bridge that get their own span and metrics, see startOperation
+const (
+	opDownload                   = "download_provider"
+	opStartProcess               = "start_process"
+	opGetProviderSchema          = "get_provider_schema"
+	opConfigureProvider          = "configure_provider"
+	opValidateDataResourceConfig = "validate_data_resource_config"
+	opReadDataSource             = "read_data_source"
+)
+
+const (
+	attrOperation   = attribute.Key("tfbridge.operation")
+	attrProvider    = attribute.Key("tfbridge.provider")
+	attrDataSource  = attribute.Key("tfbridge.data_source")
+	attrConfigure   = attribute.Key("tfbridge.configure")
+	attrError       = attribute.Key("tfbridge.error")
+	attrSeverity    = attribute.Key("tfbridge.severity")
+	attrQuals       = attribute.Key("tfbridge.quals")
+	attrRows        = attribute.Key("tfbridge.rows")
+	attrDiagnostics = attribute.Key("tfbridge.diagnostics")
+)
+
+// bridgeMetrics are the instruments of the operations. They're created on first use, once the SDK has set the meter
+// provider
+type bridgeMetrics struct {
+	duration    metric.Float64Histogram
+	rows        metric.Int64Counter
+	diagnostics metric.Int64Counter
+}
+
+var (
+	metricsOnce sync.Once
+	metrics     bridgeMetrics
+)
+
+func getMetrics() bridgeMetrics {
+	metricsOnce.Do(func() {
+		meter := otel.Meter(telemetryName)
+		var err error
+		// if any of them can't be created, its measurements are dropped instead of failing the reads
+		if metrics.duration, err = meter.Float64Histogram("tfbridge.operation.duration", metric.WithUnit("ms"), metric.WithDescription("Duration of the operations of the bridge, by operation, provider and data source")); err != nil {
+			otel.Handle(err)
+			metrics.duration = noop.Float64Histogram{}
+		}
+		if metrics.rows, err = meter.Int64Counter("tfbridge.read.rows", metric.WithDescription("Rows read from data sources, by provider and data source")); err != nil {
+			otel.Handle(err)
+			metrics.rows = noop.Int64Counter{}
+		}
+		if metrics.diagnostics, err = meter.Int64Counter("tfbridge.diagnostics", metric.WithDescription("Diagnostics returned by providers, by operation, provider, data source and severity")); err != nil {
+			otel.Handle(err)
+			metrics.diagnostics = noop.Int64Counter{}
+		}
+	})
+	return metrics
+}
+
+// operation is the span of an operation of the bridge, plus what's recorded on the metrics when it ends
+type operation struct {
+	ctx   context.Context
+	span  trace.Span
+	start time.Time
+	// attrs go on the metrics too, so they must not take many distinct values
+	attrs []attribute.KeyValue
+	rows  *int
+}
+
+// startOperation starts the span of one of the op* operations on provider (its source address), as a child of the
+// span on ctx if there's one, e.g. that of the SDK for the query
+// attrs are set on the span and on the metrics. The returned context carries the span, so that the operations that it
+// does (e.g. reading the schema to configure the provider) are its children
+func startOperation(ctx context.Context, name, provider string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	attrs = append([]attribute.KeyValue{attrOperation.String(name), attrProvider.String(provider)}, attrs...)
+	ctx, span := telemetry.StartSpan(ctx, telemetryName, "tfbridge.%s", name)
+	span.SetAttributes(attrs...)
+	return ctx, &operation{ctx: ctx, span: span, start: time.Now(), attrs: attrs}
+}
+
+// setQuals adds the names of the quals to the span, but never their values, which may be secrets
+func (o *operation) setQuals(quals map[string]*proto.QualValue) {
+	keys := make([]string, 0, len(quals))
+	for k := range quals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	o.span.SetAttributes(attrQuals.StringSlice(keys))
+}
+
+// setRows is the number of rows that the operation returned
+func (o *operation) setRows(rows int) {
+	o.rows = &rows
+}
+
+// end ends the span, and records the metrics of the operation. err is what the operation returns, and diags are the
+// diagnostics returned by the provider, if any (err usually comes from them)
+func (o *operation) end(err error, diags tfdiags.Diagnostics) {
+	m := getMetrics()
+
+	o.span.SetAttributes(attrDiagnostics.Int(len(diags)))
+	for _, d := range diags {
+		severity := "warning"
+		if d.Severity() == tfdiags.Error {
+			severity = "error"
+		}
+		m.diagnostics.Add(o.ctx, 1, metric.WithAttributes(append(o.attrs, attrSeverity.String(severity))...))
+	}
+	if o.rows != nil {
+		o.span.SetAttributes(attrRows.Int(*o.rows))
+		m.rows.Add(o.ctx, int64(*o.rows), metric.WithAttributes(o.attrs...))
+	}
+	if err != nil {
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	m.duration.Record(o.ctx, float64(time.Since(o.start).Microseconds())/1000, metric.WithAttributes(append(o.attrs, attrError.Bool(err != nil))...))
+	o.span.End()
+}
+
+// sourceAddress normalizes the source of a provider block like the schema key does, so that all operations of a
+// provider get the same provider attribute
+func sourceAddress(source string) string {
+	provider, err := tfaddr.ParseProviderSource(source)
+	if err != nil {
+		return source
+	}
+	return provider.String()
+}
+
+// providerSource returns the source address of the provider behind conn, for the provider attribute of operations
+// that only get the connection. It comes from the schema key, see getPluginConnection
+func providerSource(conn providers.Interface) string {
+	if p, ok := conn.(*pooledProvider); ok {
+		conn = p.Interface
+	}
+	var key string
+	switch p := conn.(type) {
+	case *tfplugin.GRPCProvider:
+		key = p.SchemaKey
+	case *tfplugin6.GRPCProvider:
+		key = p.SchemaKey
+	}
+	// the last part is the version, or the PID of reattached providers (see reattachSchemaKey)
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
@@ -0,0 +1,376 @@
+package tfbridge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/addrs"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// lockFileName is where `terraform init` records the exact version that it picked for each provider
+const lockFileName = ".terraform.lock.hcl"
+
+var (
+	terraformFileSchema = &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{Type: "terraform"},
+			{Type: "provider", LabelNames: []string{"name"}},
+			{Type: "variable", LabelNames: []string{"name"}},
+		},
+	}
+	terraformBlockSchema = &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "required_providers"}},
+	}
+	lockFileSchema = &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "provider", LabelNames: []string{"source"}}},
+	}
+	// both variable blocks and lock file entries have other arguments (and blocks) that are of no use here
+	versionSchema = &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: "version"}},
+	}
+	variableSchema = &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: "default"}},
+	}
+)
+
+// providerMetaArguments are the arguments of provider blocks that are handled by Terraform itself, and so are
+// removed before the body is sent to the provider
+var providerMetaArguments = []string{"alias", "version"}
+
+// requiredProvider is an entry of a required_providers block
+type requiredProvider struct {
+	source     string
+	constraint string
+}
+
+// loadTerraformDir reads the providers used by the Terraform module (i.e. the .tf files, not recursively) in dir
+// Every provider on a required_providers block, or with a provider block, becomes a ProviderBlock, whose source is
+// normalized like Terraform does (so "integrations/github" becomes "registry.terraform.io/integrations/github").
+// The version is the one on .terraform.lock.hcl if present, or the version constraint if it names a single version
+// Provider blocks keep their body as provider_config (minus meta-arguments), and any var.* references on it are
+// resolved from the variable defaults, TF_VAR_ environment variables, terraform.tfvars and *.auto.tfvars, in that
+// order of precedence like in Terraform. Other references (locals, resources, functions) aren't supported
+func loadTerraformDir(dir string) ([]ProviderBlock, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, fmt.Errorf("reading terraform_dir: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("terraform_dir %s has no .tf files", dir)
+	}
+	sort.Strings(files)
+
+	parser := hclparse.NewParser()
+	required := map[string]requiredProvider{}
+	var providerBlocks []*hclsyntax.Block
+	var variableBlocks []*hcl.Block
+	for _, path := range files {
+		f, diags := parser.ParseHCLFile(path)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		content, _, diags := f.Body.PartialContent(terraformFileSchema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		for _, block := range content.Blocks {
+			switch block.Type {
+			case "terraform":
+				if err := readRequiredProviders(block, required); err != nil {
+					return nil, err
+				}
+			case "provider":
+				// ParseHCLFile always returns native syntax, whose source is needed for the provider config
+				providerBlocks = append(providerBlocks, findSyntaxBlock(f.Body.(*hclsyntax.Body), block))
+			case "variable":
+				variableBlocks = append(variableBlocks, block)
+			}
+		}
+	}
+
+	variables, err := readVariables(parser, dir, variableBlocks)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := readLockFile(parser, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// providers that have no provider block still get an (empty) configuration, like in Terraform
+	var names []string
+	configured := map[string]bool{}
+	var blocks []ProviderBlock
+	for _, b := range providerBlocks {
+		name := b.Labels[0]
+		if !configured[name] {
+			names = append(names, name)
+			configured[name] = true
+		}
+		block, err := readProviderBlock(parser.Sources()[b.Range().Filename], b, variables)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	var unconfigured []string
+	for name := range required {
+		if !configured[name] {
+			unconfigured = append(unconfigured, name)
+		}
+	}
+	sort.Strings(unconfigured)
+	for _, name := range unconfigured {
+		names = append(names, name)
+		blocks = append(blocks, ProviderBlock{Name: name, variables: variables})
+	}
+
+	// then fill in source and version, which all blocks of a provider share
+	var result []ProviderBlock
+	for _, name := range names {
+		source, constraint := required[name].source, required[name].constraint
+		addr := addrs.ImpliedProviderForUnqualifiedType(name)
+		if source != "" {
+			var diags tfdiags.Diagnostics
+			if addr, diags = addrs.ParseProviderSourceString(source); diags.HasErrors() {
+				return nil, fmt.Errorf("invalid source %q of provider %q: %w", source, name, diags.Err())
+			}
+		}
+		// built-in providers (i.e. terraform_remote_state) aren't downloadable
+		if addr.IsBuiltIn() {
+			continue
+		}
+
+		v, ok := locked[addr.String()]
+		if !ok {
+			if v, ok = exactVersion(constraint); !ok {
+				return nil, fmt.Errorf("provider %q needs an exact version: run terraform init on %s to create %s, or use a version constraint that names a single version instead of %q", name, dir, lockFileName, constraint)
+			}
+		}
+		for _, b := range blocks {
+			if b.Name == name {
+				b.Source, b.Version = addr.String(), v
+				result = append(result, b)
+			}
+		}
+	}
+	return result, nil
+}
+
+// readRequiredProviders adds the entries of the required_providers blocks inside a terraform block to required
+// Entries are either objects with source and version, or (before Terraform 0.13) just a version constraint
+func readRequiredProviders(block *hcl.Block, required map[string]requiredProvider) error {
+	content, _, diags := block.Body.PartialContent(terraformBlockSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, rp := range content.Blocks {
+		attrs, diags := rp.Body.JustAttributes()
+		if diags.HasErrors() {
+			return diags
+		}
+		for name, attr := range attrs {
+			var entry requiredProvider
+			// configuration_aliases holds references to providers, which can't be evaluated, so the object is
+			// read item by item
+			if obj, ok := attr.Expr.(*hclsyntax.ObjectConsExpr); ok {
+				for _, item := range obj.Items {
+					key := hcl.ExprAsKeyword(item.KeyExpr)
+					// keys may also be quoted
+					if k, diags := item.KeyExpr.Value(nil); key == "" && !diags.HasErrors() && k.Type() == cty.String {
+						key = k.AsString()
+					}
+					if key != "source" && key != "version" {
+						continue
+					}
+					val, diags := item.ValueExpr.Value(nil)
+					if diags.HasErrors() {
+						return diags
+					}
+					if val.Type() != cty.String || val.IsNull() {
+						return fmt.Errorf("%s of provider %q on required_providers must be a string", key, name)
+					}
+					if key == "source" {
+						entry.source = val.AsString()
+					} else {
+						entry.constraint = val.AsString()
+					}
+				}
+			} else {
+				val, diags := attr.Expr.Value(nil)
+				if diags.HasErrors() {
+					return diags
+				}
+				if val.Type() != cty.String || val.IsNull() {
+					return fmt.Errorf("provider %q on required_providers must be an object or a version string", name)
+				}
+				entry.constraint = val.AsString()
+			}
+			required[name] = entry
+		}
+	}
+	return nil
+}
+
+// findSyntaxBlock returns the native syntax block that block was decoded from
+func findSyntaxBlock(body *hclsyntax.Body, block *hcl.Block) *hclsyntax.Block {
+	for _, b := range body.Blocks {
+		if b.Type == block.Type && b.TypeRange == block.TypeRange {
+			return b
+		}
+	}
+	return nil
+}
+
+// readProviderBlock turns a provider block into a ProviderBlock, whose provider_config is the source code of the
+// block's body without the meta-arguments, so that comments and formatting show up unchanged on logs
+func readProviderBlock(src []byte, block *hclsyntax.Block, variables map[string]cty.Value) (ProviderBlock, error) {
+	p := ProviderBlock{Name: block.Labels[0], variables: variables}
+
+	start, end := block.OpenBraceRange.End.Byte, block.CloseBraceRange.Start.Byte
+	var remove []hcl.Range
+	for _, name := range providerMetaArguments {
+		attr, ok := block.Body.Attributes[name]
+		if !ok {
+			continue
+		}
+		remove = append(remove, attr.SrcRange)
+		if name == "alias" {
+			val, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() {
+				return p, diags
+			}
+			if val.Type() != cty.String || val.IsNull() {
+				return p, fmt.Errorf("alias of provider %q must be a string", p.Name)
+			}
+			alias := val.AsString()
+			p.Alias = &alias
+		}
+	}
+
+	// cut the meta-arguments out, from the end so that the earlier offsets stay valid
+	sort.Slice(remove, func(i, j int) bool { return remove[i].Start.Byte > remove[j].Start.Byte })
+	body := string(src[start:end])
+	for _, r := range remove {
+		body = body[:r.Start.Byte-start] + body[r.End.Byte-start:]
+	}
+	body = strings.TrimSpace(body)
+	p.ProviderConfig = &body
+	return p, nil
+}
+
+// readVariables returns the values of the input variables of the module, see loadTerraformDir
+// Variables without a value are left out, so references to them fail when configuring the provider
+func readVariables(parser *hclparse.Parser, dir string, blocks []*hcl.Block) (map[string]cty.Value, error) {
+	variables := map[string]cty.Value{}
+	declared := map[string]bool{}
+	for _, block := range blocks {
+		name := block.Labels[0]
+		declared[name] = true
+		content, _, diags := block.Body.PartialContent(variableSchema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if def, ok := content.Attributes["default"]; ok {
+			val, diags := def.Expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			variables[name] = val
+		}
+	}
+
+	// like in Terraform, these are always strings
+	for _, env := range os.Environ() {
+		k, v, _ := strings.Cut(env, "=")
+		if name := strings.TrimPrefix(k, "TF_VAR_"); name != k && declared[name] {
+			variables[name] = cty.StringVal(v)
+		}
+	}
+
+	autoFiles, err := filepath.Glob(filepath.Join(dir, "*.auto.tfvars"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(autoFiles)
+	for _, path := range append([]string{filepath.Join(dir, "terraform.tfvars")}, autoFiles...) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		f, diags := parser.ParseHCLFile(path)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		attrs, diags := f.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		for name, attr := range attrs {
+			val, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			variables[name] = val
+		}
+	}
+	return variables, nil
+}
+
+// readLockFile returns the version of each provider on the dependency lock file, keyed by the full source address
+// A missing lock file (if terraform init was never run) is the same as an empty one
+func readLockFile(parser *hclparse.Parser, dir string) (map[string]string, error) {
+	path := filepath.Join(dir, lockFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	f, diags := parser.ParseHCLFile(path)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	content, _, diags := f.Body.PartialContent(lockFileSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	locked := map[string]string{}
+	for _, block := range content.Blocks {
+		content, _, diags := block.Body.PartialContent(versionSchema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		attr, ok := content.Attributes["version"]
+		if !ok {
+			continue
+		}
+		val, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if val.Type() == cty.String && !val.IsNull() {
+			locked[block.Labels[0]] = val.AsString()
+		}
+	}
+	return locked, nil
+}
+
+// exactVersion returns the version named by a constraint such as "5.33.0" or "= 5.33.0", and false for constraints
+// that allow more than one version (such as "~> 5.33"), since the bridge can't pick one of them by itself
+func exactVersion(constraint string) (string, bool) {
+	if cs, err := version.NewConstraint(constraint); err != nil || len(cs) != 1 {
+		return "", false
+	}
+	v, err := version.NewVersion(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(constraint), "=")))
+	if err != nil {
+		return "", false
+	}
+	return v.String(), true
+}
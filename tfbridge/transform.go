@@ -25,12 +25,32 @@ Mapping rules are:
 */
 func ctyValToSteampipeVal(ctx context.Context, tf *transform.TransformData) (interface{}, error) {
 	entireItem := tf.HydrateItem.(map[string]cty.Value)
-	key := tf.Param.(string)
-	plugin.Logger(ctx).Info("ctyValToSteampipeVal", "k", key, "item", entireItem)
+	path := tf.Param.([]string)
+	// only the path is logged, never the values: rows may hold secrets (e.g. those of ephemeral resources, see
+	// tableTFBridgeEphemeral), and this runs once per column of every row
+	plugin.Logger(ctx).Trace("ctyValToSteampipeVal", "path", path)
 
-	val, ok := entireItem[key]
+	val, ok := entireItem[path[0]]
 	if !ok {
-		return nil, fmt.Errorf("cty.ValueAsMap %v has no field %s", entireItem, key)
+		return nil, fmt.Errorf("row has no field %s", path[0])
+	}
+	// the rest of the path goes through flattened blocks (see makeFields), which hold a single object
+	for _, key := range path[1:] {
+		if val.IsNull() || !val.IsKnown() {
+			return nil, nil
+		}
+		if val.Type().IsListType() || val.Type().IsSetType() {
+			if val.LengthInt() == 0 {
+				return nil, nil
+			}
+			it := val.ElementIterator()
+			it.Next()
+			_, val = it.Element()
+		}
+		val = val.GetAttr(key)
+	}
+	if len(path) > 1 && (val.IsNull() || !val.IsKnown()) {
+		return nil, nil
 	}
 
 	// in this switch, the primary thing that changes is the type of x
@@ -68,15 +88,21 @@ func ctyValToSteampipeVal(ctx context.Context, tf *transform.TransformData) (int
 
 		var x map[string]any
 		json.Unmarshal(asJson, &x)
-		plugin.Logger(ctx).Info("ctyValToSteampipeVal.json", "asJson", asJson, "x", x)
 		return x, nil
 	default:
-		return nil, fmt.Errorf("value %v with type %v is not recognized", val, val.Type())
+		return nil, fmt.Errorf("value of type %v at %v is not recognized", val.Type().FriendlyName(), path)
 	}
 }
 
 func FromCtyMapKey(key string) *transform.ColumnTransforms {
+	return FromCtyMapPath([]string{key})
+}
+
+// FromCtyMapPath is like FromCtyMapKey, but it reaches into nested blocks that hold a single object: the first
+// element of path is a key of the row, and the rest are attributes inside the nested blocks
+// If any of the blocks along the way is null or empty, the column is null too
+func FromCtyMapPath(path []string) *transform.ColumnTransforms {
 	return &transform.ColumnTransforms{Transforms: []*transform.TransformCall{
-		{Transform: ctyValToSteampipeVal, Param: key},
+		{Transform: ctyValToSteampipeVal, Param: path},
 	}}
 }
@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"strings"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/configschema"
 	"github.com/jreyesr/steampipe-plugin-tfbridge/logging"
 	tfplugin "github.com/jreyesr/steampipe-plugin-tfbridge/plugin"
 	tfplugin6 "github.com/jreyesr/steampipe-plugin-tfbridge/plugin6"
 	"github.com/jreyesr/steampipe-plugin-tfbridge/providers"
+	"github.com/jreyesr/steampipe-plugin-tfbridge/tfdiags"
 	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
 	spPlugin "github.com/turbot/steampipe-plugin-sdk/v5/plugin"
 	"github.com/zclconf/go-cty/cty"
@@ -26,52 +30,118 @@ var Handshake = plugin.HandshakeConfig{
 	MagicCookieValue: "d602bf8f470bc67ca7faa0386276bbdd4330efaf76d1a219cb4d6991ca9872b2",
 }
 
-func getPluginConnection(pluginPath string) (providers.Interface, error) {
-	client := plugin.NewClient(&plugin.ClientConfig{
+// getPluginConnection starts a process of the provider of instance, or connects to it if it's already running (see
+// GetReattachProviders). The schema key and cache dir of instance let the provider reuse a schema read by another
+// process, see providers.SchemaCache
+// logPrefix names the process in the logs, and must be unique so that its panics can be found, see
+// logging.ProviderPanic
+// The logs of the provider go to the Steampipe plugin log, named after the connection that started the process (which
+// may be shared by others) and the provider address, see processOptions.logLevel
+func getPluginConnection(ctx context.Context, instance *providerInstance, logPrefix string) (providers.Interface, error) {
+	logName := fmt.Sprintf("%s.%s[%s]", instance.connection, instance.Source, strings.TrimSuffix(logPrefix, "."))
+	logger := logging.NewProviderLogger(logPrefix, logName, spPlugin.Logger(ctx), instance.process.logLevel, instance.process.logFile)
+	config := &plugin.ClientConfig{
 		HandshakeConfig:  Handshake,
 		VersionedPlugins: tfplugin.VersionedPlugins,
-		Cmd:              exec.Command("sh", "-c", pluginPath),
 		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
-		Managed:          true,
-		Logger:           logging.NewProviderLogger(""),
-		SyncStdout:       logging.PluginOutputMonitor(fmt.Sprintf("%s:stdout", "dns")),
-		SyncStderr:       logging.PluginOutputMonitor(fmt.Sprintf("%s:stderr", "dns")),
-	})
+		Logger:           logger,
+		SyncStdout:       logging.PluginOutputMonitor(fmt.Sprintf("%s:stdout", logPrefix+"provider"), logger),
+		SyncStderr:       logging.PluginOutputMonitor(fmt.Sprintf("%s:stderr", logPrefix+"provider"), logger),
+	}
+	if instance.reattach != nil {
+		if err := checkReattachAddr(instance.reattach); err != nil {
+			return nil, err
+		}
+		// like Terraform does for unmanaged providers, the process isn't ours to start nor to kill
+		config.Reattach = instance.reattach
+		config.VersionedPlugins = nil
+		config.Plugins = tfplugin.VersionedPlugins[instance.reattach.ProtocolVersion]
+		if config.Plugins == nil {
+			return nil, fmt.Errorf("unsupported protocol version %d for reattached provider", instance.reattach.ProtocolVersion)
+		}
+	} else {
+		// the binary is run directly, without a shell, and only gets the environment of the connection
+		cmd := exec.Command(instance.pluginLocation)
+		cmd.Env = instance.process.env
+		cmd.Dir = instance.process.dir
+		config.Cmd = cmd
+		config.SkipHostEnv = true
+		config.Managed = true
+		// like Terraform does, the provider must prove that it's the process that was started, and only this plugin
+		// can talk to it. Reattached providers can't use it, go-plugin only supports it for processes that it starts
+		config.AutoMTLS = instance.process.autoMTLS
+	}
+	client := plugin.NewClient(config)
 
+	if _, err := client.Start(); err != nil {
+		return nil, err
+	}
+	// go-plugin only loads the certificate of the provider if it sent one on the handshake. Providers built with very
+	// old SDKs ignore the client's certificate and serve plain gRPC, which would fail later with an obscure TLS error
+	if config.AutoMTLS && config.TLSConfig.RootCAs == nil {
+		client.Kill()
+		return nil, fmt.Errorf("the provider didn't negotiate mTLS (it's probably built with a very old plugin SDK), set provider_auto_mtls = false to connect to it without TLS")
+	}
 	rpcClient, err := client.Client()
 	if err != nil {
+		client.Kill()
+		if config.AutoMTLS {
+			return nil, fmt.Errorf("couldn't connect to the provider over mTLS (set provider_auto_mtls = false if it doesn't support it): %w", err)
+		}
 		return nil, err
 	}
+	if instance.reattach == nil && instance.process.limits.any() {
+		if err := setProcessLimits(client.ReattachConfig().Pid, instance.process.limits); err != nil {
+			client.Kill()
+			return nil, err
+		}
+	}
 
 	x, err := rpcClient.Dispense("provider") // Grab the provider
 	if err != nil {
+		client.Kill()
 		return nil, err
 	}
 	// store the client so that the plugin can kill the child process
-	protoVer := client.NegotiatedVersion()
-	switch protoVer {
-	case 5:
-		p := x.(*tfplugin.GRPCProvider)
+	// reattached providers may not report the protocol version, so go by the type of what was dispensed
+	switch p := x.(type) {
+	case *tfplugin.GRPCProvider:
 		p.PluginClient = client
+		p.SchemaKey, p.SchemaCacheDir = instance.schemaKey, instance.schemaCacheDir
 		return p, nil
-	case 6:
-		p := x.(*tfplugin6.GRPCProvider)
+	case *tfplugin6.GRPCProvider:
 		p.PluginClient = client
+		p.SchemaKey, p.SchemaCacheDir = instance.schemaKey, instance.schemaCacheDir
 		return p, nil
 	default:
+		client.Kill()
 		return nil, fmt.Errorf("can't cast %v (%T) to GRPCProvider", x, x)
 	}
 }
 
+// readProviderSchema gets the schema of provider, which usually comes from the schema cache (see
+// providers.SchemaCache), under its own span
+func readProviderSchema(ctx context.Context, provider providers.Interface) providers.GetProviderSchemaResponse {
+	ctx, op := startOperation(ctx, opGetProviderSchema, providerSource(provider))
+	schema := provider.GetProviderSchema(ctx)
+	op.end(schema.Diagnostics.Err(), schema.Diagnostics)
+	return schema
+}
+
 func getProviderSchema(ctx context.Context, provider providers.Interface) hcldec.Spec {
-	schema := provider.GetProviderSchema()
+	schema := readProviderSchema(ctx, provider)
 	spec := schema.Provider.Block.DecoderSpec()
 
 	return spec
 }
 
-func configureProvider(ctx context.Context, provider providers.Interface, rawConfig string) error {
-	spPlugin.Logger(ctx).Debug("configureProvider", "rawConfig", rawConfig)
+// variables are the values of the var.* references on rawConfig, if any
+// The diagnostics are those returned by the provider, which may hold warnings even if it succeeds
+func configureProvider(ctx context.Context, provider providers.Interface, rawConfig string, variables map[string]cty.Value) (diags tfdiags.Diagnostics, err error) {
+	ctx, op := startOperation(ctx, opConfigureProvider, providerSource(provider))
+	defer func() { op.end(err, diags) }()
+	// the config holds credentials, either written on it or substituted from var.*, so its values are never logged
+	spPlugin.Logger(ctx).Debug("configureProvider", "variables", len(variables))
 
 	// grab config schema from provider
 	spec := getProviderSchema(ctx, provider)
@@ -79,35 +149,68 @@ func configureProvider(ctx context.Context, provider providers.Interface, rawCon
 	// parse HCL string using provider's schema as blueprint
 	// if it fails, user wrote incorrect HCL string on .spc file
 	parser := hclparse.NewParser()
-	f, err := parser.ParseHCL([]byte(rawConfig), "config.hcl")
-	if err != nil {
-		spPlugin.Logger(ctx).Error("configureProvider.ParseHCL", "rawConfig", rawConfig, "err", err)
-		return err
+	// these return hcl.Diagnostics, which can't go into err directly, or a nil one would become a non-nil error
+	f, parseDiags := parser.ParseHCL([]byte(rawConfig), "config.hcl")
+	if parseDiags != nil {
+		spPlugin.Logger(ctx).Error("configureProvider.ParseHCL", "err", parseDiags)
+		return nil, parseDiags
 	}
-	cfgVal, err := hcldec.Decode(f.Body, spec, &hcl.EvalContext{})
-	if err != nil {
-		spPlugin.Logger(ctx).Error("configureProvider.Decode", "body", f.Body, "spec", spec)
-		return err
+	evalCtx := &hcl.EvalContext{}
+	if len(variables) > 0 {
+		evalCtx.Variables = map[string]cty.Value{"var": cty.ObjectVal(variables)}
+	}
+	cfgVal, decodeDiags := hcldec.Decode(f.Body, spec, evalCtx)
+	if decodeDiags != nil {
+		spPlugin.Logger(ctx).Error("configureProvider.Decode", "err", decodeDiags)
+		return nil, decodeDiags
 	}
 
 	configType := hcldec.ImpliedType(spec)
-	spPlugin.Logger(ctx).Debug("configureProvider", "parsedConfigType", configType, "parsedConfig", cfgVal)
+	spPlugin.Logger(ctx).Debug("configureProvider", "parsedConfigType", configType)
 
 	// ACTUALLY send the configure RPC to provider binary
-	configureResponse := provider.ConfigureProvider(providers.ConfigureProviderRequest{
+	configureResponse := provider.ConfigureProvider(ctx, providers.ConfigureProviderRequest{
 		TerraformVersion: "999.0.0",
 		Config:           cfgVal,
 	})
 	if configureResponse.Diagnostics.HasErrors() {
-		spPlugin.Logger(ctx).Error("configureProvider.ConfigureProvider", "config", cfgVal, "err", configureResponse.Diagnostics.Err())
-		return configureResponse.Diagnostics.Err()
+		spPlugin.Logger(ctx).Error("configureProvider.ConfigureProvider", "err", configureResponse.Diagnostics.Err())
+		return configureResponse.Diagnostics, configureResponse.Diagnostics.Err()
 	}
 
-	return nil
+	return configureResponse.Diagnostics, nil
+}
+
+// pluginClient returns the go-plugin client that runs the process of conn, see getPluginConnection, and the version
+// of the plugin protocol that it uses
+func pluginClient(conn providers.Interface) (*plugin.Client, int) {
+	switch p := conn.(type) {
+	case *tfplugin.GRPCProvider:
+		return p.PluginClient, 5
+	case *tfplugin6.GRPCProvider:
+		return p.PluginClient, 6
+	default:
+		return nil, 0
+	}
 }
 
-func getDataSources(provider providers.Interface) (map[string]providers.Schema, error) {
-	schema := provider.GetProviderSchema()
+// schemaCacheKey identifies a provider and version on the schema cache, e.g.
+// registry.terraform.io/hashicorp/aws/5.0.0. source must be valid, see makeProviderTables
+func schemaCacheKey(source, version string) string {
+	provider, _ := tfaddr.ParseProviderSource(source)
+	return provider.String() + "/" + version
+}
+
+func getMetadata(ctx context.Context, provider providers.Interface) (providers.GetMetadataResponse, error) {
+	metadata := provider.GetMetadata(ctx)
+	if metadata.Diagnostics.HasErrors() {
+		return metadata, metadata.Diagnostics.Err()
+	}
+	return metadata, nil
+}
+
+func getDataSources(ctx context.Context, provider providers.Interface) (map[string]providers.Schema, error) {
+	schema := readProviderSchema(ctx, provider)
 	if schema.Diagnostics.HasErrors() {
 		return nil, schema.Diagnostics.Err()
 	}
@@ -115,8 +218,34 @@ func getDataSources(provider providers.Interface) (map[string]providers.Schema,
 	return schema.DataSources, nil
 }
 
-func getDataSourceSchema(provider providers.Interface, dataSourceName string) (*providers.Schema, error) {
-	schemas, err := getDataSources(provider)
+func getResourceTypes(ctx context.Context, provider providers.Interface) (map[string]providers.Schema, error) {
+	schema := readProviderSchema(ctx, provider)
+	if schema.Diagnostics.HasErrors() {
+		return nil, schema.Diagnostics.Err()
+	}
+
+	return schema.ResourceTypes, nil
+}
+
+func getEphemeralResourceTypes(ctx context.Context, provider providers.Interface) (map[string]providers.Schema, error) {
+	schema := readProviderSchema(ctx, provider)
+	if schema.Diagnostics.HasErrors() {
+		return nil, schema.Diagnostics.Err()
+	}
+
+	return schema.EphemeralResourceTypes, nil
+}
+
+func getFunctions(ctx context.Context, provider providers.Interface) (map[string]providers.FunctionDecl, error) {
+	functions := provider.GetFunctions(ctx)
+	if functions.Diagnostics.HasErrors() {
+		return nil, functions.Diagnostics.Err()
+	}
+	return functions.Functions, nil
+}
+
+func getDataSourceSchema(ctx context.Context, provider providers.Interface, dataSourceName string) (*providers.Schema, error) {
+	schemas, err := getDataSources(ctx, provider)
 	if err != nil {
 		return nil, err
 	}
@@ -129,8 +258,16 @@ func getDataSourceSchema(provider providers.Interface, dataSourceName string) (*
 	return &schema, nil
 }
 
-func readDataSource(ctx context.Context, provider providers.Interface, dataSourceName string, quals map[string]*proto.QualValue) (*cty.Value, error) {
-	dsSchema, err := getDataSourceSchema(provider, dataSourceName)
+// readDataSource reads a data source, using the quals as its config
+// quals are keyed by column name, the fields of index tell which attribute (possibly inside a flattened block) each
+// column is
+func readDataSource(ctx context.Context, provider providers.Interface, dataSourceName string, quals map[string]*proto.QualValue, index *tableIndex) (_ *cty.Value, err error) {
+	ctx, op := startOperation(ctx, opReadDataSource, providerSource(provider), attrDataSource.String(dataSourceName))
+	op.setQuals(quals)
+	var diags tfdiags.Diagnostics
+	defer func() { op.end(err, diags) }()
+
+	dsSchema, err := getDataSourceSchema(ctx, provider, dataSourceName)
 	if err != nil {
 		spPlugin.Logger(ctx).Warn("readDataSource.getDataSourceSchema", "provider", provider, "dataSource", dataSourceName)
 		return nil, err
@@ -138,73 +275,160 @@ func readDataSource(ctx context.Context, provider providers.Interface, dataSourc
 	dsSchemaType := dsSchema.Block.ImpliedType()
 	spPlugin.Logger(ctx).Debug("readDataSource", "dsSchema", dsSchema, "dsSchemaType", dsSchemaType)
 
+	dsSchemaVal, err := qualsToConfig(ctx, quals, index.getFields(dsSchema.Block), dsSchemaType)
+	if err != nil {
+		return nil, err
+	}
+
+	// like Terraform does, the provider checks the config before reading, which may catch mistakes with a better message
+	if err := validateDataResourceConfig(ctx, provider, dataSourceName, dsSchemaVal); err != nil {
+		return nil, err
+	}
+
+	// now provide the cty.Value to the RPC interface
+	// if the query is cancelled while the provider is still working (e.g. the user hit Ctrl-C, or a LIMIT
+	// was already satisfied), the RPC itself is cancelled and the provider is asked to halt its own work
+	stop := stopOnCancel(ctx, provider)
+	readResponse := provider.ReadDataSource(ctx, providers.ReadDataSourceRequest{
+		TypeName:     dataSourceName,
+		Config:       dsSchemaVal,
+		ProviderMeta: cty.EmptyObjectVal,
+	})
+	stop()
+	diags = readResponse.Diagnostics
+	if readResponse.Diagnostics.HasErrors() {
+		return nil, readResponse.Diagnostics.Err()
+	}
+	spPlugin.Logger(ctx).Debug("readDataSource.response", "response", readResponse.State)
+	op.setRows(1)
+
+	return &readResponse.State, nil
+}
+
+func validateDataResourceConfig(ctx context.Context, provider providers.Interface, dataSourceName string, config cty.Value) error {
+	ctx, op := startOperation(ctx, opValidateDataResourceConfig, providerSource(provider), attrDataSource.String(dataSourceName))
+	validateResponse := provider.ValidateDataResourceConfig(ctx, providers.ValidateDataResourceConfigRequest{
+		TypeName: dataSourceName,
+		Config:   config,
+	})
+	err := validateResponse.Diagnostics.Err()
+	op.end(err, validateResponse.Diagnostics)
+	if validateResponse.Diagnostics.HasErrors() {
+		spPlugin.Logger(ctx).Warn("validateDataResourceConfig", "dataSource", dataSourceName, "err", err)
+		return err
+	}
+	return nil
+}
+
+// qualsToConfig builds the configuration of a data source (or ephemeral resource) of type ty from the quals
+// quals are looked up by column, since some columns may have been renamed (see makeColumnNames), and
+// then placed at the field's path, which rebuilds any flattened blocks (see makeFields)
+// Quals are often secrets (always, for ephemeral resources), so only the names of their columns are logged
+func qualsToConfig(ctx context.Context, quals map[string]*proto.QualValue, fields []tableField, ty cty.Type) (cty.Value, error) {
 	simpleQuals := make(map[string]any)
-	for k, v := range quals {
-		if attr, ok := dsSchema.Block.Attributes[k]; ok {
+	var columns []string
+	for _, f := range fields {
+		v, ok := quals[f.column]
+		if !ok {
+			continue
+		}
+		columns = append(columns, f.column)
+		if attr := f.attribute; attr != nil {
 			switch {
 			case attr.Type == cty.Number:
-				simpleQuals[k] = v.GetDoubleValue()
+				setQualAtPath(simpleQuals, f, v.GetDoubleValue())
 			case attr.Type == cty.String:
-				simpleQuals[k] = v.GetStringValue()
+				setQualAtPath(simpleQuals, f, v.GetStringValue())
 			case attr.Type == cty.Bool:
-				simpleQuals[k] = v.GetBoolValue()
+				setQualAtPath(simpleQuals, f, v.GetBoolValue())
 			case attr.Type.IsMapType() || attr.Type.IsObjectType(): // deserialize JSON string to map[string]any
 				var d map[string]any
 				err := json.Unmarshal([]byte(v.GetJsonbValue()), &d)
 				if err != nil {
-					return nil, err
+					return cty.NilVal, err
 				}
-				simpleQuals[k] = d
+				setQualAtPath(simpleQuals, f, d)
 			case attr.Type.IsListType() || attr.Type.IsTupleType() || attr.Type.IsSetType(): // deserialize JSON string to []any
 				var d []any
 				err := json.Unmarshal([]byte(v.GetJsonbValue()), &d)
 				if err != nil {
-					return nil, err
+					return cty.NilVal, err
 				}
-				simpleQuals[k] = d
+				setQualAtPath(simpleQuals, f, d)
 			default:
 				errmsg := fmt.Errorf("type %v can't be handled by quals", attr.Type)
-				spPlugin.Logger(ctx).Warn("readDataSource.makeSimpleQuals.unsupported", "qualName", k, "qual", v, "typeInSchema", attr.Type, "err", errmsg)
-				return nil, errmsg
+				spPlugin.Logger(ctx).Warn("qualsToConfig.makeSimpleQuals.unsupported", "qualName", f.column, "typeInSchema", attr.Type, "err", errmsg)
+				return cty.NilVal, errmsg
 			}
-		}
-		if _, ok := dsSchema.Block.BlockTypes[k]; ok {
+		} else {
 			// if qual matches a nested block, it must have come packed in a JSONB field
-			var d map[string]any
+			var d any
 			err := json.Unmarshal([]byte(v.GetJsonbValue()), &d)
 			if err != nil {
-				return nil, err
+				return cty.NilVal, err
 			}
-			simpleQuals[k] = d
+			setQualAtPath(simpleQuals, f, d)
 		}
 	}
 	// do the dance: marshal quals into JSON string...
 	qualsString, err := json.Marshal(simpleQuals)
 	if err != nil {
-		spPlugin.Logger(ctx).Warn("readDataSource.jsonMarshal", "err", err, "quals", simpleQuals)
-		return nil, err
+		spPlugin.Logger(ctx).Warn("qualsToConfig.jsonMarshal", "err", err, "columns", columns)
+		return cty.NilVal, err
 	}
 
 	// ... and then deserialize into cty.Value, using the expected type as a guide
 	// https://pkg.go.dev/github.com/zclconf/go-cty@v1.13.2/cty/json#Unmarshal
-	dsSchemaVal, err := ctyjson.Unmarshal(qualsString, dsSchemaType)
+	config, err := ctyjson.Unmarshal(qualsString, ty)
 	if err != nil {
-		spPlugin.Logger(ctx).Warn("readDataSource.ctyUnmarshal", "err", err, "quals", string(qualsString), "schema", dsSchemaType)
-		return nil, err
+		spPlugin.Logger(ctx).Warn("qualsToConfig.ctyUnmarshal", "err", err, "columns", columns, "schema", ty)
+		return cty.NilVal, err
 	}
 
-	spPlugin.Logger(ctx).Debug("readDataSource", "quals", simpleQuals, "readConfig", dsSchemaVal)
+	spPlugin.Logger(ctx).Debug("qualsToConfig", "columns", columns)
+	return config, nil
+}
 
-	// now provide the cty.Value to the RPC interface
-	readResponse := provider.ReadDataSource(providers.ReadDataSourceRequest{
-		TypeName:     dataSourceName,
-		Config:       dsSchemaVal,
-		ProviderMeta: cty.EmptyObjectVal,
-	})
-	if readResponse.Diagnostics.HasErrors() {
-		return nil, readResponse.Diagnostics.Err()
+// setQualAtPath stores value in quals at the field's path, creating the flattened blocks that contain it
+// Blocks that hold a single object are JSON objects, and lists or sets with a single element are JSON arrays
+// holding that object, which is what ctyjson.Unmarshal expects for each kind of block
+func setQualAtPath(quals map[string]any, f tableField, value any) {
+	current := quals
+	for i, parent := range f.parents {
+		name := f.path[i]
+		var next map[string]any
+		switch existing := current[name].(type) {
+		case map[string]any:
+			next = existing
+		case []any:
+			next = existing[0].(map[string]any)
+		default:
+			next = make(map[string]any)
+			if parent.Nesting == configschema.NestingList || parent.Nesting == configschema.NestingSet {
+				current[name] = []any{next}
+			} else {
+				current[name] = next
+			}
+		}
+		current = next
 	}
-	spPlugin.Logger(ctx).Debug("readDataSource.response", "response", readResponse.State)
+	current[f.path[len(f.path)-1]] = value
+}
 
-	return &readResponse.State, nil
+// stopOnCancel issues a Stop RPC to the provider if ctx is done before the returned func is called.
+// The returned func must be called as soon as the guarded RPC returns, so that the provider isn't stopped
+// after it has already finished its work
+func stopOnCancel(ctx context.Context, provider providers.Interface) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			spPlugin.Logger(ctx).Info("stopOnCancel", "reason", ctx.Err())
+			if err := provider.Stop(); err != nil {
+				spPlugin.Logger(ctx).Warn("stopOnCancel.Stop", "err", err)
+			}
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package tfdiags
+
+import "google.golang.org/grpc/codes"
+
+// ExtraInfo tries to retrieve extra information of interface type T from
+// the given diagnostic.
+//
+// If the given diagnostic's extra value has an implementation of interface T
+// then ExtraInfo returns a non-nil interface value. If there is no such
+// implementation, ExtraInfo returns a nil T.
+//
+// Although the signature of this function does not constrain T to be an
+// interface type, our convention is to only use interface types to access
+// extra info in order to allow for alternative or wrapping implementations
+// of the interface.
+func ExtraInfo[T any](diag Diagnostic) T {
+	extra := diag.ExtraInfo()
+	if ret, ok := extra.(T); ok {
+		return ret
+	}
+
+	var zero T
+	return zero
+}
+
+// WithExtra returns a diagnostic that behaves exactly like the given one,
+// except that its ExtraInfo method returns the given extra value.
+func WithExtra(diag Diagnostic, extra interface{}) Diagnostic {
+	return diagnosticWithExtra{
+		Diagnostic: diag,
+		extra:      extra,
+	}
+}
+
+type diagnosticWithExtra struct {
+	Diagnostic
+	extra interface{}
+}
+
+func (d diagnosticWithExtra) ExtraInfo() interface{} {
+	return d.extra
+}
+
+// DiagnosticExtraGRPCStatus can be implemented by the extra info of
+// diagnostics that were created from a failed gRPC call to a plugin, so that
+// callers can react to the status code of the call (e.g. a plugin that
+// crashed, which is reported as codes.Unavailable).
+type DiagnosticExtraGRPCStatus interface {
+	GRPCStatusCode() codes.Code
+}
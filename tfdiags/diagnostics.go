@@ -5,6 +5,7 @@ package tfdiags
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sort"
@@ -236,6 +237,17 @@ func (dae diagnosticsAsError) WrappedErrors() []error {
 	return errs
 }
 
+// ErrDiagnostics returns the diagnostics that were turned into the given
+// error by Diagnostics.Err, looking through any errors that wrap it. If the
+// error didn't originate from a set of diagnostics, the result is nil.
+func ErrDiagnostics(err error) Diagnostics {
+	var dae diagnosticsAsError
+	if errors.As(err, &dae) {
+		return dae.Diagnostics
+	}
+	return nil
+}
+
 // NonFatalError is a special error type, returned by
 // Diagnostics.ErrWithWarnings and Diagnostics.NonFatalErr,
 // that indicates that the wrapped diagnostics should be treated as non-fatal.